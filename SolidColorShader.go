@@ -5,10 +5,11 @@ type SolidColorShader struct {
 	Matrix Matrix
 	Color  Color
 	Thickness float64
+	linear    bool
 }
 
 func NewSolidColorShader(matrix Matrix, color Color, thickness float64) *SolidColorShader {
-	return &SolidColorShader{matrix, color, thickness}
+	return &SolidColorShader{Matrix: matrix, Color: color, Thickness: thickness}
 }
 
 func (s *SolidColorShader) Vertex(v Vertex) Vertex {
@@ -17,6 +18,20 @@ func (s *SolidColorShader) Vertex(v Vertex) Vertex {
 	return v
 }
 
+func (s *SolidColorShader) configure(dc *Context) {
+	s.linear = dc.ColorSpace == ColorSpaceSRGB
+}
+
+func (s *SolidColorShader) setCamera(c *Camera) {
+	s.Matrix = c.Matrix()
+}
+
+func (s *SolidColorShader) withMatrix(m Matrix) Shader {
+	c := *s
+	c.Matrix = s.Matrix.Mul(m)
+	return &c
+}
+
 func (s *SolidColorShader) Fragment(v Vertex, fromObject *Object) Color {
-	return s.Color
+	return decodeColor(s.Color, s.linear)
 }
@@ -21,6 +21,9 @@ type ToonShader struct {
 	// Rim Lighting
 	RimColor Color
 	RimSize  float64 // How much of the edge the rim light should cover (0-1)
+
+	linear bool
+	hdr    bool
 }
 
 func NewToonShader(matrix Matrix, lightDir, cameraPosition Vector, ambient, diffuse Color) *ToonShader {
@@ -43,6 +46,26 @@ func NewToonShader(matrix Matrix, lightDir, cameraPosition Vector, ambient, diff
 	}
 }
 
+func (s *ToonShader) configure(dc *Context) {
+	s.linear = dc.ColorSpace == ColorSpaceSRGB
+	s.hdr = dc.HDRBuffer != nil
+}
+
+func (s *ToonShader) viewProjection() Matrix {
+	return s.Matrix
+}
+
+func (s *ToonShader) setCamera(c *Camera) {
+	s.Matrix = c.Matrix()
+	s.CameraPosition = c.Eye
+}
+
+func (s *ToonShader) withMatrix(m Matrix) Shader {
+	c := *s
+	c.Matrix = s.Matrix.Mul(m)
+	return &c
+}
+
 func (s *ToonShader) Vertex(v Vertex) Vertex {
 	v.Output = s.Matrix.MulPositionW(v.Position)
 	normalMatrix := s.Matrix.Inverse().Transpose()
@@ -52,9 +75,12 @@ func (s *ToonShader) Vertex(v Vertex) Vertex {
 
 func (s *ToonShader) Fragment(v Vertex, fromObject *Object) Color {
 	light := s.AmbientColor
-	color := fromObject.Color
+	color := decodeColor(fromObject.Color, s.linear)
 	if fromObject.Texture != nil {
 		sample := fromObject.Texture.Sample(v.Texture.X, v.Texture.Y)
+		if s.linear {
+			sample = sample.linearPremultiplied()
+		}
 		if sample.A > 0 {
 			color = color.Lerp(sample.DivScalar(sample.A), sample.A)
 		}
@@ -68,5 +94,9 @@ func (s *ToonShader) Fragment(v Vertex, fromObject *Object) Color {
 	
 
 	// The final color is the object's color multiplied by the calculated light.
-	return color.Mul(light).Min(White) // Using .Min(White) to prevent color blowout
+	final := color.Mul(light).Add(fromObject.Emissive.Alpha(0))
+	if s.hdr {
+		return final
+	}
+	return final.Min(White) // Using .Min(White) to prevent color blowout
 }
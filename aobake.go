@@ -0,0 +1,209 @@
+package aeno
+
+import (
+	"image"
+	"math"
+)
+
+// AOBaker bakes ambient occlusion by casting rays from points on a mesh
+// against its own triangles.
+type AOBaker struct {
+	// Samples is the number of rays per point, spread over the hemisphere
+	// around the normal with a cosine distribution.
+	Samples int
+	// Distance is how far geometry occludes. 0 means any distance.
+	Distance float64
+	// Padding is the number of texels BakeTexture grows each UV island by,
+	// so that filtering near the seams does not pick up unbaked texels.
+	Padding int
+	// Seed selects the random rays. The same seed bakes the same result.
+	Seed int64
+}
+
+// NewAOBaker returns an AOBaker casting samples rays per point.
+func NewAOBaker(samples int, distance float64) *AOBaker {
+	return &AOBaker{Samples: samples, Distance: distance, Padding: 2}
+}
+
+// BakeVertexColors sets the Color of every vertex of the mesh to a gray
+// level from 0 when fully occluded to 1 when open. Vertices sharing a
+// position and normal get the same value. The occlusion is sRGB encoded,
+// as vertex colors are, so shading with ColorSpaceSRGB multiplies by the
+// linear value. Set Object.UseVertexColor to shade with it.
+func (b *AOBaker) BakeVertexColors(m *Mesh) {
+	type key struct{ p, n Vector }
+	index := make(map[key]int)
+	var keys []key
+	for _, t := range m.Triangles {
+		for _, v := range [...]*Vertex{&t.V1, &t.V2, &t.V3} {
+			k := key{v.Position, aoNormal(t, v.Normal)}
+			if _, ok := index[k]; !ok {
+				index[k] = len(keys)
+				keys = append(keys, k)
+			}
+		}
+	}
+	bvh, eps := m.BVH(), aoBias(m)
+	ao := make([]float64, len(keys))
+	parallel(len(keys), func(i int) {
+		rnd := newPTRand(b.Seed, i, 0, 0)
+		ao[i] = b.ambient(bvh, keys[i].p, keys[i].n, eps, &rnd)
+	})
+	for _, t := range m.Triangles {
+		for _, v := range [...]*Vertex{&t.V1, &t.V2, &t.V3} {
+			v.Color = Gray(linearToSRGB(ao[index[key{v.Position, aoNormal(t, v.Normal)}]]))
+		}
+	}
+}
+
+// BakeTexture bakes the occlusion of the mesh into a width by height image
+// laid out by the vertex texture coordinates, white where open. Texels no
+// triangle covers stay white after Padding. Like BakeVertexColors, the
+// image is sRGB encoded, as textures are.
+func (b *AOBaker) BakeTexture(m *Mesh, width, height int) *image.Gray {
+	owner, bary := uvCoverage(m, width, height)
+	bvh, eps := m.BVH(), aoBias(m)
+	ao := make([]float64, width*height)
+	parallel(height, func(y int) {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			if owner[i] < 0 {
+				continue
+			}
+			t := m.Triangles[owner[i]]
+			w := VectorW{bary[i].X, bary[i].Y, bary[i].Z, 1}
+			p := InterpolateVectors(t.V1.Position, t.V2.Position, t.V3.Position, w)
+			n := InterpolateVectors(t.V1.Normal, t.V2.Normal, t.V3.Normal, w).Normalize()
+			rnd := newPTRand(b.Seed, x, y, 0)
+			ao[i] = b.ambient(bvh, p, aoNormal(t, n), eps, &rnd)
+		}
+	})
+	covered := make([]bool, len(owner))
+	for i, o := range owner {
+		covered[i] = o >= 0
+	}
+	dilate(covered, width, height, b.Padding, func(i int, from []int) {
+		sum := 0.0
+		for _, j := range from {
+			sum += ao[j]
+		}
+		ao[i] = sum / float64(len(from))
+	})
+
+	im := image.NewGray(image.Rect(0, 0, width, height))
+	for i, v := range ao {
+		im.Pix[i] = 255
+		if covered[i] {
+			im.Pix[i] = uint8(linearToSRGB(Clamp(v, 0, 1))*255 + 0.5)
+		}
+	}
+	return im
+}
+
+// ambient returns the fraction of rays from p that leave without hitting
+// the BVH within Distance.
+func (b *AOBaker) ambient(bvh *BVH, p, n Vector, eps float64, rnd *ptRand) float64 {
+	tMax := b.Distance
+	if tMax <= 0 {
+		tMax = math.Inf(1)
+	}
+	origin := p.Add(n.MulScalar(eps))
+	samples := maxInt(b.Samples, 1)
+	open := 0
+	for i := 0; i < samples; i++ {
+		d := cosineSample(n, rnd.float(), rnd.float())
+		if !bvh.Occluded(Ray{origin, d}, tMax) {
+			open++
+		}
+	}
+	return float64(open) / float64(samples)
+}
+
+// aoNormal returns n, or the face normal of t when n is zero.
+func aoNormal(t *Triangle, n Vector) Vector {
+	if n == (Vector{}) {
+		return t.Normal()
+	}
+	return n.Normalize()
+}
+
+// aoBias is the distance rays start off the surface, to avoid hitting the
+// triangle they leave from.
+func aoBias(m *Mesh) float64 {
+	return 1e-5 * (1 + m.BoundingBox().Size().MaxComponent())
+}
+
+// uvCoverage rasterizes the mesh in texture space. For every texel of a
+// width by height image whose center a triangle covers, owner holds the
+// index of the first such triangle and bary the weights of its corners
+// there. owner is -1 elsewhere.
+func uvCoverage(m *Mesh, width, height int) (owner []int32, bary []Vector) {
+	owner = make([]int32, width*height)
+	bary = make([]Vector, width*height)
+	for i := range owner {
+		owner[i] = -1
+	}
+	size := Vector{float64(width), float64(height), 0}
+	for ti, t := range m.Triangles {
+		a := Vector{t.V1.Texture.X, t.V1.Texture.Y, 0}.Mul(size)
+		b := Vector{t.V2.Texture.X, t.V2.Texture.Y, 0}.Mul(size)
+		c := Vector{t.V3.Texture.X, t.V3.Texture.Y, 0}.Mul(size)
+		if b.Sub(a).Cross(c.Sub(a)).Z == 0 {
+			continue
+		}
+		lo, hi := a.Min(b).Min(c), a.Max(b).Max(c)
+		x0 := maxInt(int(math.Floor(lo.X)), 0)
+		y0 := maxInt(int(math.Floor(lo.Y)), 0)
+		x1 := minInt(int(math.Ceil(hi.X)), width)
+		y1 := minInt(int(math.Ceil(hi.Y)), height)
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				i := y*width + x
+				if owner[i] >= 0 {
+					continue
+				}
+				w := barycentric(Vector{float64(x) + 0.5, float64(y) + 0.5, 0}, a, b, c)
+				const eps = -1e-9
+				if w.X < eps || w.Y < eps || w.Z < eps {
+					continue
+				}
+				owner[i] = int32(ti)
+				bary[i] = w
+			}
+		}
+	}
+	return owner, bary
+}
+
+// dilate grows the covered texels of a width by height image by n texels,
+// marking them covered. fill is called for every new texel i with the
+// covered neighbours it should take its value from.
+func dilate(covered []bool, width, height, n int, fill func(i int, from []int)) {
+	next := make([]bool, len(covered))
+	from := make([]int, 0, 8)
+	for pass := 0; pass < n; pass++ {
+		copy(next, covered)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				i := y*width + x
+				if covered[i] {
+					continue
+				}
+				from = from[:0]
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := x+dx, y+dy
+						if nx >= 0 && ny >= 0 && nx < width && ny < height && covered[ny*width+nx] {
+							from = append(from, ny*width+nx)
+						}
+					}
+				}
+				if len(from) > 0 {
+					fill(i, from)
+					next[i] = true
+				}
+			}
+		}
+		copy(covered, next)
+	}
+}
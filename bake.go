@@ -0,0 +1,111 @@
+package aeno
+
+import "image"
+
+// BakeTarget selects what Context.Bake writes.
+type BakeTarget int
+
+const (
+	_ BakeTarget = iota
+	// BakeLighting writes the output of the Context shader, giving a
+	// lightmap with the object's colors and textures already applied.
+	BakeLighting
+	// BakeAlbedo writes the unlit surface color, as PhongShader takes it
+	// from the object color, vertex colors and texture.
+	BakeAlbedo
+	// BakeNormal writes the world-space normal, mapped from [-1, 1] to
+	// [0, 1] and stored without color space encoding.
+	BakeNormal
+)
+
+// Bake draws the object into the Context in texture space: each vertex is
+// placed at its texture coordinate, with u across and v down the buffers,
+// while the shader sees world-space positions and normals. Culling, the
+// depth test and blending are off during the bake. Afterwards the texels
+// around the drawn UV islands are filled from their neighbours, padding
+// texels deep, so that filtering near seams does not pick up the clear
+// color. Use a Context without HDRBuffer for BakeNormal.
+func (dc *Context) Bake(o *Object, target BakeTarget, padding int) {
+	shader := dc.Shader
+	cull, readDepth, blend, viewport := dc.Cull, dc.ReadDepth, dc.AlphaBlend, dc.Viewport
+	dc.Shader = &bakeShader{
+		shader: shader,
+		target: target,
+		matrix: o.Matrix,
+		normal: o.Matrix.Inverse().Transpose(),
+	}
+	dc.Cull, dc.ReadDepth, dc.AlphaBlend, dc.Viewport = CullNone, false, false, image.Rectangle{}
+	dc.DrawMesh(o.Mesh, o)
+	dc.Shader = shader
+	dc.Cull, dc.ReadDepth, dc.AlphaBlend, dc.Viewport = cull, readDepth, blend, viewport
+	dc.Resolve()
+	if padding <= 0 {
+		return
+	}
+
+	owner, _ := uvCoverage(o.Mesh, dc.Width, dc.Height)
+	covered := make([]bool, len(owner))
+	for i, t := range owner {
+		covered[i] = t >= 0
+	}
+	pix := dc.ColorBuffer.Pix
+	dilate(covered, dc.Width, dc.Height, padding, func(i int, from []int) {
+		var sum [4]int
+		for _, j := range from {
+			for c := 0; c < 4; c++ {
+				sum[c] += int(pix[j*4+c])
+			}
+		}
+		for c := 0; c < 4; c++ {
+			pix[i*4+c] = uint8((sum[c] + len(from)/2) / len(from))
+		}
+	})
+}
+
+// bakeShader places vertices at their texture coordinates and shades them
+// in world space with the wrapped shader.
+type bakeShader struct {
+	shader Shader
+	target BakeTarget
+	matrix Matrix
+	normal Matrix
+	linear bool
+}
+
+func (s *bakeShader) configure(dc *Context) {
+	s.linear = dc.ColorSpace == ColorSpaceSRGB
+	if cs, ok := s.shader.(contextShader); ok {
+		cs.configure(dc)
+	}
+}
+
+func (s *bakeShader) Vertex(v Vertex) Vertex {
+	uv := v.Texture
+	v.Position = s.matrix.MulPosition(v.Position)
+	v.Normal = s.normal.MulDirection(v.Normal)
+	v.Output = VectorW{uv.X*2 - 1, 1 - uv.Y*2, 0, 1}
+	return v
+}
+
+func (s *bakeShader) Fragment(v Vertex, o *Object) Color {
+	return s.FragmentGrad(v, Vector{}, Vector{}, o)
+}
+
+func (s *bakeShader) FragmentGrad(v Vertex, dx, dy Vector, o *Object) Color {
+	switch s.target {
+	case BakeAlbedo:
+		return objectColor(o, v, dx, dy, s.linear)
+	case BakeNormal:
+		n := v.Normal.MulScalar(0.5).AddScalar(0.5)
+		c := Color{n.X, n.Y, n.Z, 1}
+		if s.linear {
+			// Undo the sRGB encoding applied when the color is stored.
+			c = c.Linear()
+		}
+		return c
+	}
+	if gs, ok := s.shader.(GradientShader); ok {
+		return gs.FragmentGrad(v, dx, dy, o)
+	}
+	return s.shader.Fragment(v, o)
+}
@@ -0,0 +1,401 @@
+package aeno
+
+import "math"
+
+// BVH is a bounding volume hierarchy over the triangles of a mesh, built
+// with the surface area heuristic. Triangles are referred to by their index
+// in the slice it was built from. It does not follow later changes to the
+// triangles.
+type BVH struct {
+	nodes []bvhNode
+	// order maps leaf positions to triangle indexes, tris holds the
+	// triangles in leaf order.
+	order []int
+	tris  []bvhTriangle
+}
+
+// bvhNode is an inner node when count is 0, with children at first and
+// first+1, and otherwise a leaf holding count triangles from first.
+type bvhNode struct {
+	box   Box
+	first int
+	count int
+}
+
+// bvhTriangle stores a triangle as a corner and two edges.
+type bvhTriangle struct {
+	a, e1, e2 Vector
+}
+
+func (t *bvhTriangle) box() Box {
+	b, c := t.a.Add(t.e1), t.a.Add(t.e2)
+	return Box{t.a.Min(b).Min(c), t.a.Max(b).Max(c)}
+}
+
+const (
+	bvhBins    = 16
+	bvhMaxLeaf = 8
+)
+
+// NewBVH builds a BVH over triangles.
+func NewBVH(triangles []*Triangle) *BVH {
+	n := len(triangles)
+	bvh := &BVH{
+		order: make([]int, n),
+		tris:  make([]bvhTriangle, n),
+	}
+	boxes := make([]Box, n)
+	centers := make([]Vector, n)
+	for i, t := range triangles {
+		bvh.order[i] = i
+		boxes[i] = t.BoundingBox()
+		centers[i] = boxes[i].Center()
+	}
+	bvh.nodes = append(bvh.nodes, bvhNode{})
+	if n > 0 {
+		bvh.build(0, 0, n, boxes, centers)
+	}
+	for i, j := range bvh.order {
+		t := triangles[j]
+		a := t.V1.Position
+		bvh.tris[i] = bvhTriangle{a, t.V2.Position.Sub(a), t.V3.Position.Sub(a)}
+	}
+	return bvh
+}
+
+func boxArea(b Box) float64 {
+	d := b.Size()
+	return 2 * (d.X*d.Y + d.Y*d.Z + d.Z*d.X)
+}
+
+func (bvh *BVH) build(node, start, end int, boxes []Box, centers []Vector) {
+	items := bvh.order[start:end]
+	box := boxes[items[0]]
+	cmin, cmax := centers[items[0]], centers[items[0]]
+	for _, i := range items[1:] {
+		box = box.Extend(boxes[i])
+		cmin = cmin.Min(centers[i])
+		cmax = cmax.Max(centers[i])
+	}
+	bvh.nodes[node] = bvhNode{box, start, len(items)}
+	if len(items) <= 2 {
+		return
+	}
+
+	// Find the cheapest binned split over all axes.
+	bestCost := math.Inf(1)
+	bestAxis, bestSplit := -1, 0
+	extent := cmax.Sub(cmin)
+	for axis := 0; axis < 3; axis++ {
+		lo, size := axisOf(cmin, axis), axisOf(extent, axis)
+		if size <= 0 {
+			continue
+		}
+		var counts [bvhBins]int
+		var bins [bvhBins]Box
+		for _, i := range items {
+			b := binIndex(axisOf(centers[i], axis), lo, size)
+			if counts[b] == 0 {
+				bins[b] = boxes[i]
+			} else {
+				bins[b] = bins[b].Extend(boxes[i])
+			}
+			counts[b]++
+		}
+		// Sweep from the right to get the cost of each right side.
+		var rightArea [bvhBins]float64
+		var rightCount [bvhBins]int
+		var acc Box
+		count := 0
+		for b := bvhBins - 1; b > 0; b-- {
+			if counts[b] > 0 {
+				if count == 0 {
+					acc = bins[b]
+				} else {
+					acc = acc.Extend(bins[b])
+				}
+				count += counts[b]
+			}
+			rightCount[b] = count
+			rightArea[b] = boxArea(acc)
+		}
+		count = 0
+		for b := 0; b < bvhBins-1; b++ {
+			if counts[b] > 0 {
+				if count == 0 {
+					acc = bins[b]
+				} else {
+					acc = acc.Extend(bins[b])
+				}
+				count += counts[b]
+			}
+			if count == 0 || rightCount[b+1] == 0 {
+				continue
+			}
+			cost := boxArea(acc)*float64(count) + rightArea[b+1]*float64(rightCount[b+1])
+			if cost < bestCost {
+				bestCost, bestAxis, bestSplit = cost, axis, b+1
+			}
+		}
+	}
+
+	small := len(items) <= bvhMaxLeaf
+	if small && (bestAxis < 0 || bestCost >= boxArea(box)*float64(len(items))) {
+		return
+	}
+
+	// Without a split axis all centers coincide; halve so leaves stay small.
+	mid := len(items) / 2
+	if bestAxis >= 0 {
+		lo, size := axisOf(cmin, bestAxis), axisOf(extent, bestAxis)
+		mid = partitionInts(items, func(i int) bool {
+			return binIndex(axisOf(centers[i], bestAxis), lo, size) < bestSplit
+		})
+	}
+
+	left := len(bvh.nodes)
+	bvh.nodes = append(bvh.nodes, bvhNode{}, bvhNode{})
+	bvh.nodes[node] = bvhNode{box, left, 0}
+	bvh.build(left, start, start+mid, boxes, centers)
+	bvh.build(left+1, start+mid, end, boxes, centers)
+}
+
+func axisOf(v Vector, axis int) float64 {
+	switch axis {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	}
+	return v.Z
+}
+
+func binIndex(x, lo, size float64) int {
+	return ClampInt(int((x-lo)/size*bvhBins), 0, bvhBins-1)
+}
+
+// partitionInts moves the items for which fn is true to the front and
+// returns their count.
+func partitionInts(items []int, fn func(int) bool) int {
+	j := 0
+	for i, x := range items {
+		if fn(x) {
+			items[i], items[j] = items[j], items[i]
+			j++
+		}
+	}
+	return j
+}
+
+// Box returns the bounds of all triangles.
+func (bvh *BVH) Box() Box {
+	if len(bvh.tris) == 0 {
+		return EmptyBox
+	}
+	return bvh.nodes[0].box
+}
+
+// rayBox returns the ray parameter where the ray enters box, and whether it
+// does so before tMax.
+func rayBox(o, inv Vector, b Box, tMax float64) (float64, bool) {
+	tx1, tx2 := (b.Min.X-o.X)*inv.X, (b.Max.X-o.X)*inv.X
+	ty1, ty2 := (b.Min.Y-o.Y)*inv.Y, (b.Max.Y-o.Y)*inv.Y
+	tz1, tz2 := (b.Min.Z-o.Z)*inv.Z, (b.Max.Z-o.Z)*inv.Z
+	t0 := math.Max(math.Max(math.Min(tx1, tx2), math.Min(ty1, ty2)), math.Min(tz1, tz2))
+	t1 := math.Min(math.Min(math.Max(tx1, tx2), math.Max(ty1, ty2)), math.Max(tz1, tz2))
+	return t0, t1 >= math.Max(t0, 0) && t0 < tMax
+}
+
+// intersect returns the ray parameter and the weights of the second and
+// third corner where the ray hits the triangle, from either side.
+func (t *bvhTriangle) intersect(r Ray) (float64, float64, float64, bool) {
+	const eps = 1e-12
+	p := r.Direction.Cross(t.e2)
+	det := t.e1.Dot(p)
+	if math.Abs(det) < eps {
+		return 0, 0, 0, false
+	}
+	inv := 1 / det
+	s := r.Origin.Sub(t.a)
+	u := s.Dot(p) * inv
+	if u < 0 || u > 1 {
+		return 0, 0, 0, false
+	}
+	q := s.Cross(t.e1)
+	v := r.Direction.Dot(q) * inv
+	if v < 0 || u+v > 1 {
+		return 0, 0, 0, false
+	}
+	return t.e2.Dot(q) * inv, u, v, true
+}
+
+// Intersect returns the nearest hit of the ray with T in (0, tMax].
+// Triangles are hit from both sides.
+func (bvh *BVH) Intersect(r Ray, tMax float64) (Hit, bool) {
+	return bvh.traverse(r, tMax, false)
+}
+
+// Occluded reports whether the ray hits any triangle with T in (0, tMax],
+// stopping at the first hit found. It is cheaper than Intersect for
+// shadow and occlusion rays.
+func (bvh *BVH) Occluded(r Ray, tMax float64) bool {
+	_, ok := bvh.traverse(r, tMax, true)
+	return ok
+}
+
+func (bvh *BVH) traverse(r Ray, tMax float64, anyHit bool) (Hit, bool) {
+	const eps = 1e-9
+	if len(bvh.tris) == 0 {
+		return Hit{}, false
+	}
+	inv := Vector{1 / r.Direction.X, 1 / r.Direction.Y, 1 / r.Direction.Z}
+	hit := Hit{T: tMax, Triangle: -1}
+	stack := make([]int, 0, 64)
+	if _, ok := rayBox(r.Origin, inv, bvh.nodes[0].box, tMax); ok {
+		stack = append(stack, 0)
+	}
+	for len(stack) > 0 {
+		node := &bvh.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if node.count > 0 {
+			for k := node.first; k < node.first+node.count; k++ {
+				t, u, v, ok := bvh.tris[k].intersect(r)
+				if !ok || t <= eps || t > hit.T {
+					continue
+				}
+				hit = Hit{T: t, Triangle: bvh.order[k], Barycentric: Vector{1 - u - v, u, v}}
+				if anyHit {
+					return hit, true
+				}
+			}
+			continue
+		}
+		// Visit the nearer child first.
+		a, b := node.first, node.first+1
+		ta, okA := rayBox(r.Origin, inv, bvh.nodes[a].box, hit.T)
+		tb, okB := rayBox(r.Origin, inv, bvh.nodes[b].box, hit.T)
+		if okA && okB && tb < ta {
+			a, b = b, a
+		}
+		if okB {
+			stack = append(stack, b)
+		}
+		if okA {
+			stack = append(stack, a)
+		}
+	}
+	return hit, hit.Triangle >= 0
+}
+
+// ClosestPoint returns the point on the triangles nearest to p and the
+// index of its triangle, or -1 when there are no triangles.
+func (bvh *BVH) ClosestPoint(p Vector) (Vector, int) {
+	if len(bvh.tris) == 0 {
+		return Vector{}, -1
+	}
+	best := math.Inf(1)
+	var point Vector
+	index := -1
+	stack := append(make([]int, 0, 64), 0)
+	for len(stack) > 0 {
+		node := &bvh.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if boxDistanceSquared(node.box, p) >= best {
+			continue
+		}
+		if node.count > 0 {
+			for k := node.first; k < node.first+node.count; k++ {
+				q := bvh.tris[k].closestPoint(p)
+				if d := q.DistanceSquared(p); d < best {
+					best, point, index = d, q, bvh.order[k]
+				}
+			}
+			continue
+		}
+		a, b := node.first, node.first+1
+		if boxDistanceSquared(bvh.nodes[a].box, p) < boxDistanceSquared(bvh.nodes[b].box, p) {
+			a, b = b, a
+		}
+		stack = append(stack, a, b)
+	}
+	return point, index
+}
+
+func boxDistanceSquared(b Box, p Vector) float64 {
+	d := b.Min.Sub(p).Max(p.Sub(b.Max)).Max(Vector{})
+	return d.LengthSquared()
+}
+
+// closestPoint returns the point of the triangle nearest to p, following
+// Ericson's Real-Time Collision Detection.
+func (t *bvhTriangle) closestPoint(p Vector) Vector {
+	a, ab, ac := t.a, t.e1, t.e2
+	ap := p.Sub(a)
+	d1, d2 := ab.Dot(ap), ac.Dot(ap)
+	if d1 <= 0 && d2 <= 0 {
+		return a
+	}
+	bp := ap.Sub(ab)
+	d3, d4 := ab.Dot(bp), ac.Dot(bp)
+	if d3 >= 0 && d4 <= d3 {
+		return a.Add(ab)
+	}
+	vc := d1*d4 - d3*d2
+	if vc <= 0 && d1 >= 0 && d3 <= 0 {
+		return a.Add(ab.MulScalar(d1 / (d1 - d3)))
+	}
+	cp := ap.Sub(ac)
+	d5, d6 := ab.Dot(cp), ac.Dot(cp)
+	if d6 >= 0 && d5 <= d6 {
+		return a.Add(ac)
+	}
+	vb := d5*d2 - d1*d6
+	if vb <= 0 && d2 >= 0 && d6 <= 0 {
+		return a.Add(ac.MulScalar(d2 / (d2 - d6)))
+	}
+	va := d3*d6 - d5*d4
+	if va <= 0 && d4-d3 >= 0 && d5-d6 >= 0 {
+		w := (d4 - d3) / ((d4 - d3) + (d5 - d6))
+		return a.Add(ab).Add(ac.Sub(ab).MulScalar(w))
+	}
+	denom := 1 / (va + vb + vc)
+	v, w := vb*denom, vc*denom
+	return a.Add(ab.MulScalar(v)).Add(ac.MulScalar(w))
+}
+
+// QueryBox returns the indexes of the triangles whose bounding boxes
+// intersect b.
+func (bvh *BVH) QueryBox(b Box) []int {
+	return bvh.query(b.Intersects)
+}
+
+// QueryFrustum returns the indexes of the triangles whose bounding boxes
+// may be inside the frustum.
+func (bvh *BVH) QueryFrustum(f ViewFrustum) []int {
+	return bvh.query(f.IntersectsBox)
+}
+
+func (bvh *BVH) query(test func(Box) bool) []int {
+	var result []int
+	if len(bvh.tris) == 0 {
+		return result
+	}
+	stack := append(make([]int, 0, 64), 0)
+	for len(stack) > 0 {
+		node := &bvh.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if !test(node.box) {
+			continue
+		}
+		if node.count > 0 {
+			for k := node.first; k < node.first+node.count; k++ {
+				if test(bvh.tris[k].box()) {
+					result = append(result, bvh.order[k])
+				}
+			}
+			continue
+		}
+		stack = append(stack, node.first, node.first+1)
+	}
+	return result
+}
@@ -0,0 +1,102 @@
+package aeno
+
+// Projection selects how a Camera maps view space to the image.
+type Projection int
+
+const (
+	_ Projection = iota
+	ProjectionPerspective
+	ProjectionOrthographic
+)
+
+// Camera describes where a Scene is viewed from and how it is projected.
+type Camera struct {
+	Eye        Vector
+	Center     Vector
+	Up         Vector
+	Projection Projection
+	// Fovy is the vertical field of view in degrees, used by
+	// ProjectionPerspective.
+	Fovy float64
+	// OrthoHeight is the height of the view volume in world units, used by
+	// ProjectionOrthographic. Its width is OrthoHeight * Aspect.
+	OrthoHeight float64
+	// Aspect is the width of the image divided by its height.
+	Aspect float64
+	Near   float64
+	Far    float64
+}
+
+// NewPerspectiveCamera returns a perspective camera.
+func NewPerspectiveCamera(eye, center, up Vector, fovy, aspect, near, far float64) *Camera {
+	return &Camera{
+		Eye:        eye,
+		Center:     center,
+		Up:         up,
+		Projection: ProjectionPerspective,
+		Fovy:       fovy,
+		Aspect:     aspect,
+		Near:       near,
+		Far:        far,
+	}
+}
+
+// NewOrthographicCamera returns an orthographic camera whose view volume
+// is height world units tall.
+func NewOrthographicCamera(eye, center, up Vector, height, aspect, near, far float64) *Camera {
+	return &Camera{
+		Eye:         eye,
+		Center:      center,
+		Up:          up,
+		Projection:  ProjectionOrthographic,
+		OrthoHeight: height,
+		Aspect:      aspect,
+		Near:        near,
+		Far:         far,
+	}
+}
+
+// NewIsometricCamera returns an orthographic camera looking at center
+// from distance away along the diagonal (1, -1, 1), with Z up, so that
+// the X, Y and Z axes appear at equal angles. Geometry within distance of
+// center is kept.
+func NewIsometricCamera(center Vector, distance, height, aspect float64) *Camera {
+	eye := center.Add(Vector{1, -1, 1}.Normalize().MulScalar(distance))
+	return NewOrthographicCamera(eye, center, Vector{0, 0, 1}, height, aspect, 0, 2*distance)
+}
+
+// View returns the matrix from world space to view space.
+func (c *Camera) View() Matrix {
+	return LookAt(c.Eye, c.Center, c.Up)
+}
+
+// ProjectionMatrix returns the matrix from view space to clip space.
+func (c *Camera) ProjectionMatrix() Matrix {
+	if c.Projection == ProjectionOrthographic {
+		h := c.OrthoHeight / 2
+		w := h * c.Aspect
+		return Orthographic(-w, w, -h, h, c.Near, c.Far)
+	}
+	return Perspective(c.Fovy, c.Aspect, c.Near, c.Far)
+}
+
+// Matrix returns the view-projection matrix, for use as a shader Matrix.
+func (c *Camera) Matrix() Matrix {
+	return c.ProjectionMatrix().Mul(c.View())
+}
+
+// widen grows the view as if Fovy were increased by degrees. Orthographic
+// cameras grow by the same percentage.
+func (c *Camera) widen(degrees float64) {
+	if c.Projection == ProjectionOrthographic {
+		c.OrthoHeight *= 1 + degrees/100
+		return
+	}
+	c.Fovy += degrees
+}
+
+// cameraShader is implemented by the built-in shaders so that a Scene
+// Camera can set their matrix and camera position.
+type cameraShader interface {
+	setCamera(c *Camera)
+}
@@ -61,6 +61,56 @@ func HexColor(x string) Color {
 	return Color{float64(r) / d, float64(g) / d, float64(b) / d, float64(a) / d}
 }
 
+// Linear decodes an sRGB encoded color to linear light. Alpha is unchanged.
+func (a Color) Linear() Color {
+	return Color{srgbToLinear(a.R), srgbToLinear(a.G), srgbToLinear(a.B), a.A}
+}
+
+// SRGB encodes a linear color to sRGB. Alpha is unchanged.
+func (a Color) SRGB() Color {
+	return Color{linearToSRGB(a.R), linearToSRGB(a.G), linearToSRGB(a.B), a.A}
+}
+
+// linearPremultiplied decodes a premultiplied sRGB color, such as a texture
+// sample, to premultiplied linear light.
+func (a Color) linearPremultiplied() Color {
+	if a.A <= 0 {
+		return a
+	}
+	return a.DivScalar(a.A).Linear().MulScalar(a.A).Alpha(a.A)
+}
+
+// unpremultiply converts a premultiplied color to straight alpha.
+func (a Color) unpremultiply() Color {
+	if a.A <= 0 {
+		return Color{}
+	}
+	return a.DivScalar(a.A).Alpha(a.A)
+}
+
+func srgbToLinear(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(x float64) float64 {
+	if x <= 0.0031308 {
+		return x * 12.92
+	}
+	return 1.055*math.Pow(x, 1/2.4) - 0.055
+}
+
+// srgb8ToLinear maps 8-bit sRGB values to linear light.
+var srgb8ToLinear = func() [256]float64 {
+	var table [256]float64
+	for i := range table {
+		table[i] = srgbToLinear(float64(i) / 255)
+	}
+	return table
+}()
+
 // NRGBA returns nrgba color from fauxgl color
 func (a Color) NRGBA() color.NRGBA {
 	const d = 255.0
@@ -5,6 +5,7 @@ import (
 	"math"
 	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 type Face int
@@ -24,12 +25,37 @@ const (
 	CullBack
 )
 
+// ColorSpace selects how a Context treats color values.
+type ColorSpace int
+
+const (
+	_ ColorSpace = iota
+	// ColorSpaceNone uses colors as given: shading and blending happen on
+	// the stored values directly.
+	ColorSpaceNone
+	// ColorSpaceSRGB treats colors and textures as sRGB encoded. Shaders
+	// decode them to linear light, blending happens in linear space and
+	// the result is encoded back to sRGB when written to ColorBuffer.
+	ColorSpaceSRGB
+)
+
 type Context struct {
 	Width        int
 	Height       int
 	Shader       Shader
 	ColorBuffer  *image.NRGBA
 	DepthBuffer  []float64
+	// NormalBuffer, PositionBuffer, TextureBuffer, ObjectBuffer,
+	// TriangleBuffer and MaterialBuffer are optional render targets holding
+	// the world normal, world position, texture coordinate, object ID, mesh
+	// triangle index and material ID of the surface that wrote each pixel's
+	// depth. Allocate them with EnableTargets.
+	NormalBuffer   []Vector
+	PositionBuffer []Vector
+	TextureBuffer  []Vector
+	ObjectBuffer   []int32
+	TriangleBuffer []int32
+	MaterialBuffer []int32
 	ClearColor   Color
 	ReadDepth    bool
 	WriteDepth   bool
@@ -40,8 +66,55 @@ type Context struct {
 	Cull         Cull
 	LineWidth    float64
 	DepthBias    float64
+	ColorSpace   ColorSpace
+	// HDRBuffer is an optional floating-point color buffer holding
+	// premultiplied RGBA values. When set, fragments are accumulated here
+	// without clamping and ColorBuffer is produced by Resolve.
+	HDRBuffer    []float32
+	ToneMapping  ToneMapping
+	Exposure     float64
+	// Viewport is the rectangle of the buffers that normalized device
+	// coordinates map to. An empty rectangle means the whole buffer.
+	Viewport image.Rectangle
+	// Scissor limits rasterization and clears to a rectangle of the
+	// buffers when ScissorTest is set.
+	Scissor      image.Rectangle
+	ScissorTest  bool
+	// PostProcess is the chain of full-screen passes run, in order, by
+	// ApplyPostProcess.
+	PostProcess  []PostProcess
+	Transparency Transparency
+	// StencilBuffer is an optional 8-bit stencil buffer, allocated with
+	// EnableStencil. It holds one value per pixel, also with MSAA. When
+	// StencilTest is set, fragments are kept only if
+	// StencilFunc(StencilRef&StencilReadMask, stencil&StencilReadMask)
+	// holds, and the stored value is updated through StencilWriteMask with
+	// StencilFail, StencilDepthFail or StencilPass.
+	StencilBuffer    []uint8
+	StencilTest      bool
+	StencilFunc      CompareFunc
+	StencilRef       uint8
+	StencilReadMask  uint8
+	StencilWriteMask uint8
+	StencilFail      StencilOp
+	StencilDepthFail StencilOp
+	StencilPass      StencilOp
+	ClearStencil     uint8
 	screenMatrix Matrix
 	locks        []sync.Mutex
+	dirty        int32
+	samples      int
+	sampleColor  []float32
+	sampleDepth  []float64
+	objectIDs    sync.Map
+	objects      []*Object
+	objectsLock  sync.Mutex
+	instances    map[*Mesh][]*Object
+	oitAccum     []float64
+	oitReveal    []float64
+	transparent  int32
+	drawState    atomic.Value
+	drawLock     sync.Mutex
 }
 
 func NewContext(width, height int, shader Shader) *Context {
@@ -61,13 +134,27 @@ func NewContext(width, height int, shader Shader) *Context {
 	dc.Cull = CullBack
 	dc.LineWidth = 2
 	dc.DepthBias = 0
+	dc.ColorSpace = ColorSpaceNone
+	dc.ToneMapping = ToneMapACES
+	dc.Exposure = 1
+	dc.samples = 1
+	dc.Transparency = TransparencyBlend
+	dc.StencilFunc = CompareAlways
+	dc.StencilReadMask = 0xff
+	dc.StencilWriteMask = 0xff
+	dc.StencilFail = StencilKeep
+	dc.StencilDepthFail = StencilKeep
+	dc.StencilPass = StencilKeep
 	dc.screenMatrix = Screen(width, height)
 	dc.locks = make([]sync.Mutex, 256)
 	dc.ClearDepthBuffer()
 	return dc
 }
 
+// Image returns the color buffer, resolving the HDR buffer first if one
+// is in use.
 func (dc *Context) Image() image.Image {
+	dc.Resolve()
 	return dc.ColorBuffer
 }
 
@@ -85,10 +172,20 @@ func (dc *Context) ClearColorBufferWith(c Color) {
 	}
 	// Copy row to all rows
 	pix := dc.ColorBuffer.Pix
-	stride := dc.ColorBuffer.Stride
-	for y := 0; y < dc.Height; y++ {
-		copy(pix[y*stride:], row)
-	}
+	dc.clearSpans(func(i0, i1 int) {
+		for j := i0 * 4; j < i1*4; j += len(row) {
+			copy(pix[j:i1*4], row)
+		}
+		if dc.HDRBuffer != nil {
+			dc.clearHDRBuffer(c, i0, i1)
+		}
+		if dc.sampleColor != nil {
+			dc.clearSampleColor(c, i0, i1)
+		}
+		if dc.oitReveal != nil {
+			dc.clearTransparency(i0, i1)
+		}
+	})
 }
 
 func (dc *Context) ClearColorBuffer() {
@@ -96,8 +193,21 @@ func (dc *Context) ClearColorBuffer() {
 }
 
 func (dc *Context) ClearDepthBuffer() {
-	for i := range dc.DepthBuffer {
-		dc.DepthBuffer[i] = math.MaxFloat64
+	dc.clearSpans(func(i0, i1 int) {
+		for i := i0; i < i1; i++ {
+			dc.DepthBuffer[i] = math.MaxFloat64
+		}
+		if dc.sampleDepth != nil {
+			n := dc.samples
+			for i := i0 * n; i < i1*n; i++ {
+				dc.sampleDepth[i] = math.MaxFloat64
+			}
+		}
+		dc.clearTargets(i0, i1)
+	})
+	if !dc.ScissorTest {
+		// No pixel refers to an object anymore.
+		dc.ResetObjectIDs()
 	}
 }
 
@@ -105,14 +215,22 @@ func edge(a, b, c Vector) float64 {
 	return (b.X-c.X)*(a.Y-c.Y) - (b.Y-c.Y)*(a.X-c.X)
 }
 
-func (dc *Context) rasterize(v0, v1, v2 Vertex, s0, s1, s2 Vector, fromObject *Object) {
+func (dc *Context) rasterize(v0, v1, v2 Vertex, s0, s1, s2 Vector, tri int, fromObject *Object) {
+	if dc.samples > 1 {
+		dc.rasterizeMSAA(v0, v1, v2, s0, s1, s2, tri, fromObject)
+		return
+	}
 	min := s0.Min(s1.Min(s2)).Floor()
 	max := s0.Max(s1.Max(s2)).Ceil()
 
-	x0 := int(min.X)
-	x1 := int(max.X)
-	y0 := int(min.Y)
-	y1 := int(max.Y)
+	clip := dc.clipRect()
+	x0 := maxInt(int(min.X), clip.Min.X)
+	x1 := minInt(int(max.X), clip.Max.X-1)
+	y0 := maxInt(int(min.Y), clip.Min.Y)
+	y1 := minInt(int(max.Y), clip.Max.Y-1)
+	if x0 > x1 || y0 > y1 {
+		return
+	}
 	
 	p := Vector{float64(x0) + 0.5, float64(y0) + 0.5, 0}
 	w00 := edge(s1, s2, p)
@@ -133,6 +251,9 @@ func (dc *Context) rasterize(v0, v1, v2 Vertex, s0, s1, s2 Vector, fromObject *O
 	// Constant loop variables
 	stride := dc.Width
 	pix := dc.ColorBuffer.Pix
+	hdr := dc.HDRBuffer
+	gs, grad := dc.Shader.(GradientShader)
+	stencil := dc.stencilEnabled()
 
 	for y := y0; y <= y1; y++ {
 		w0 := w00
@@ -149,26 +270,45 @@ func (dc *Context) rasterize(v0, v1, v2 Vertex, s0, s1, s2 Vector, fromObject *O
 				z := b0*s0.Z + b1*s1.Z + b2*s2.Z
 				bz := z + dc.DepthBias
 
-				// Early depth test
-				if !dc.ReadDepth || bz <= dc.DepthBuffer[i] {
+				// Early stencil and depth test
+				depthPass := !dc.ReadDepth || bz <= dc.DepthBuffer[i]
+				if stencil && dc.stencilReject(x, y, i, depthPass) {
+					depthPass = false
+				}
+				if depthPass {
 					
 					// Interpolate
 					b := VectorW{b0 * r0, b1 * r1, b2 * r2, 0}
 					b.W = 1 / (b.X + b.Y + b.Z)
 					v := InterpolateVertexes(v0, v1, v2, b)
 
-					colorVal := dc.Shader.Fragment(v, fromObject)
+					var colorVal Color
+					if grad {
+						t0, t1, t2 := v0.Texture, v1.Texture, v2.Texture
+						dx := textureAt(t0, t1, t2, r0, r1, r2, w0+a12, w1+a20, w2+a01).Sub(v.Texture)
+						dy := textureAt(t0, t1, t2, r0, r1, r2, w0+b12, w1+b20, w2+b01).Sub(v.Texture)
+						colorVal = gs.FragmentGrad(v, dx, dy, fromObject)
+					} else {
+						colorVal = dc.Shader.Fragment(v, fromObject)
+					}
 
 					if colorVal.A > 0 {
 						// Critical Section
 						lock := &dc.locks[(x+y)&255]
 						lock.Lock()
 
-						if !dc.ReadDepth || bz <= dc.DepthBuffer[i] {
+						if dc.weighted(colorVal) {
+							if (!dc.ReadDepth || bz <= dc.DepthBuffer[i]) && dc.stencilPass(i) && dc.WriteColor {
+								dc.accumulate(i, colorVal, z, 1)
+							}
+						} else if (!dc.ReadDepth || bz <= dc.DepthBuffer[i]) && dc.stencilPass(i) {
 							if dc.WriteDepth {
 								dc.DepthBuffer[i] = z
+								dc.writeTargets(i, v, tri, fromObject)
 							}
-							if dc.WriteColor {
+							if dc.WriteColor && hdr != nil {
+								dc.setPixelHDR(colorVal, hdr, i*4)
+							} else if dc.WriteColor {
 								dc.setPixel(x, y, colorVal, pix, i*4)
 							}
 						}
@@ -186,8 +326,21 @@ func (dc *Context) rasterize(v0, v1, v2 Vertex, s0, s1, s2 Vector, fromObject *O
 	}
 }
 
+// textureAt returns the perspective-correct texture coordinate for the
+// unnormalized edge weights w0, w1 and w2.
+func textureAt(t0, t1, t2 Vector, r0, r1, r2, w0, w1, w2 float64) Vector {
+	b0 := w0 * r0
+	b1 := w1 * r1
+	b2 := w2 * r2
+	return t0.MulScalar(b0).Add(t1.MulScalar(b1)).Add(t2.MulScalar(b2)).DivScalar(b0 + b1 + b2)
+}
+
 // Inlined pixel setting for speed
 func (dc *Context) setPixel(x, y int, c Color, pix []uint8, i int) {
+	if dc.ColorSpace == ColorSpaceSRGB {
+		dc.setPixelLinear(c, pix, i)
+		return
+	}
 	if dc.AlphaBlend && c.A < 1 {
 		sr, sg, sb, sa := c.NRGBA().RGBA()
 		a := (0xffff - sa) * 0x101
@@ -211,7 +364,32 @@ func (dc *Context) setPixel(x, y int, c Color, pix []uint8, i int) {
 	}
 }
 
-func (dc *Context) line(v0, v1 Vertex, s0, s1 Vector, fromObject *Object) {
+// setPixelLinear blends a linear color over the sRGB encoded destination in
+// linear space and stores the sRGB encoded result.
+func (dc *Context) setPixelLinear(c Color, pix []uint8, i int) {
+	if dc.AlphaBlend && c.A < 1 {
+		sa := Clamp(c.A, 0, 1)
+		da := float64(pix[i+3]) / 255
+		dst := Color{srgb8ToLinear[pix[i+0]], srgb8ToLinear[pix[i+1]], srgb8ToLinear[pix[i+2]], 1}
+		a := sa + da*(1-sa)
+		if a <= 0 {
+			return
+		}
+		c = c.MulScalar(sa).Add(dst.MulScalar(da * (1 - sa))).DivScalar(a).Alpha(a)
+	}
+	nrgba := c.SRGB().NRGBA()
+	pix[i+0] = nrgba.R
+	pix[i+1] = nrgba.G
+	pix[i+2] = nrgba.B
+	pix[i+3] = nrgba.A
+}
+
+// setPixelHDR blends a color into the premultiplied float buffer.
+func (dc *Context) setPixelHDR(c Color, buf []float32, i int) {
+	blendPremultiplied(buf[i:i+4], c, dc.AlphaBlend)
+}
+
+func (dc *Context) line(v0, v1 Vertex, s0, s1 Vector, tri int, fromObject *Object) {
 	n := s1.Sub(s0).Perpendicular().MulScalar(dc.LineWidth / 2)
 	s0 = s0.Add(s0.Sub(s1).Normalize().MulScalar(dc.LineWidth / 2))
 	s1 = s1.Add(s1.Sub(s0).Normalize().MulScalar(dc.LineWidth / 2))
@@ -219,8 +397,8 @@ func (dc *Context) line(v0, v1 Vertex, s0, s1 Vector, fromObject *Object) {
 	s01 := s0.Sub(n)
 	s10 := s1.Add(n)
 	s11 := s1.Sub(n)
-	dc.rasterize(v1, v0, v0, s11, s01, s00, fromObject)
-	dc.rasterize(v1, v1, v0, s10, s11, s00, fromObject)
+	dc.rasterize(v1, v0, v0, s11, s01, s00, tri, fromObject)
+	dc.rasterize(v1, v1, v0, s10, s11, s00, tri, fromObject)
 }
 
 func (dc *Context) drawClippedLine(v0, v1 Vertex, fromObject *Object) {
@@ -228,10 +406,10 @@ func (dc *Context) drawClippedLine(v0, v1 Vertex, fromObject *Object) {
 	ndc1 := v1.Output.DivScalar(v1.Output.W).Vector()
 	s0 := dc.screenMatrix.MulPosition(ndc0)
 	s1 := dc.screenMatrix.MulPosition(ndc1)
-	dc.line(v0, v1, s0, s1, fromObject)
+	dc.line(v0, v1, s0, s1, -1, fromObject)
 }
 
-func (dc *Context) drawClippedTriangle(v0, v1, v2 Vertex, fromObject *Object) {
+func (dc *Context) drawClippedTriangle(v0, v1, v2 Vertex, tri int, fromObject *Object) {
 	ndc0 := v0.Output.DivScalar(v0.Output.W).Vector()
 	ndc1 := v1.Output.DivScalar(v1.Output.W).Vector()
 	ndc2 := v2.Output.DivScalar(v2.Output.W).Vector()
@@ -254,36 +432,120 @@ func (dc *Context) drawClippedTriangle(v0, v1, v2 Vertex, fromObject *Object) {
 	s2 := dc.screenMatrix.MulPosition(ndc2)
 
 	if dc.Wireframe {
-		dc.wireframe(v0, v1, v2, s0, s1, s2, fromObject)
+		dc.wireframe(v0, v1, v2, s0, s1, s2, tri, fromObject)
 		return 
 	}
-	dc.rasterize(v0, v1, v2, s0, s1, s2, fromObject)
+	dc.rasterize(v0, v1, v2, s0, s1, s2, tri, fromObject)
+}
+
+func (dc *Context) wireframe(v0, v1, v2 Vertex, s0, s1, s2 Vector, tri int, fromObject *Object) {
+	dc.line(v0, v1, s0, s1, tri, fromObject)
+	dc.line(v1, v2, s1, s2, tri, fromObject)
+	dc.line(v2, v0, s2, s0, tri, fromObject)
+}
+
+// drawState holds the settings the Context and its shader were last
+// prepared for.
+type drawState struct {
+	shader     contextShader
+	colorSpace ColorSpace
+	hdr        bool
+	viewport   image.Rectangle
+	weighted   bool
+}
+
+func (dc *Context) currentDrawState() drawState {
+	cs, _ := dc.Shader.(contextShader)
+	return drawState{
+		shader:     cs,
+		colorSpace: dc.ColorSpace,
+		hdr:        dc.HDRBuffer != nil,
+		viewport:   dc.Viewport,
+		weighted:   dc.Transparency == TransparencyWeighted,
+	}
+}
+
+// beginDraw prepares per-draw state before triangles are rasterized. It
+// only writes shared state when the settings changed since the last draw,
+// so DrawTriangle and DrawLine can be called from several goroutines.
+func (dc *Context) beginDraw(fromObject *Object) {
+	state := dc.currentDrawState()
+	if prev, ok := dc.drawState.Load().(drawState); !ok || prev != state {
+		dc.prepareDraw(state)
+	}
+	setFlag(&dc.dirty)
+	if state.weighted {
+		setFlag(&dc.transparent)
+	}
+	dc.registerObject(fromObject)
+}
+
+// prepareDraw configures the shader, the viewport transform and the
+// transparency buffers for state.
+func (dc *Context) prepareDraw(state drawState) {
+	dc.drawLock.Lock()
+	defer dc.drawLock.Unlock()
+	if prev, ok := dc.drawState.Load().(drawState); ok && prev == state {
+		return
+	}
+	dc.screenMatrix = dc.viewportMatrix()
+	if state.shader != nil {
+		state.shader.configure(dc)
+	}
+	if state.weighted && dc.oitReveal == nil {
+		dc.oitAccum = make([]float64, dc.Width*dc.Height*4)
+		dc.oitReveal = make([]float64, dc.Width*dc.Height)
+		dc.clearTransparency(0, dc.Width*dc.Height)
+	}
+	dc.drawState.Store(state)
 }
 
-func (dc *Context) wireframe(v0, v1, v2 Vertex, s0, s1, s2 Vector, fromObject *Object) {
-	dc.line(v0, v1, s0, s1, fromObject)
-	dc.line(v1, v2, s1, s2, fromObject)
-	dc.line(v2, v0, s2, s0, fromObject)
+// setFlag sets a flag that concurrent draws may also be setting.
+func setFlag(flag *int32) {
+	if atomic.LoadInt32(flag) == 0 {
+		atomic.StoreInt32(flag, 1)
+	}
 }
 
 func (dc *Context) DrawTriangle(t *Triangle, fromObject *Object) {
-	v1 := dc.Shader.Vertex(t.V1)
-	v2 := dc.Shader.Vertex(t.V2)
-	v3 := dc.Shader.Vertex(t.V3)
+	dc.beginDraw(fromObject)
+	dc.drawTriangle(t, -1, fromObject)
+}
+
+// drawTriangle draws t, recording tri as its index in TriangleBuffer.
+func (dc *Context) drawTriangle(t *Triangle, tri int, fromObject *Object) {
+	dc.drawTriangleWith(dc.Shader, t, tri, fromObject)
+}
+
+// drawTriangleWith is drawTriangle running the vertex stage of vs.
+func (dc *Context) drawTriangleWith(vs Shader, t *Triangle, tri int, fromObject *Object) {
+	v1 := vs.Vertex(t.V1)
+	v2 := vs.Vertex(t.V2)
+	v3 := vs.Vertex(t.V3)
 
 	if v1.Outside() || v2.Outside() || v3.Outside() {
 		triangles := ClipTriangle(NewTriangle(v1, v2, v3))
 		for _, t := range triangles {
-			dc.drawClippedTriangle(t.V1, t.V2, t.V3, fromObject)
+			dc.drawClippedTriangle(t.V1, t.V2, t.V3, tri, fromObject)
 		}
 		return
 	}
-	dc.drawClippedTriangle(v1, v2, v3, fromObject)
+	dc.drawClippedTriangle(v1, v2, v3, tri, fromObject)
 }
 
 func (dc *Context) DrawLine(l *Line, fromObject *Object) {
-	v1 := dc.Shader.Vertex(l.V1)
-	v2 := dc.Shader.Vertex(l.V2)
+	dc.beginDraw(fromObject)
+	dc.drawLine(l, fromObject)
+}
+
+func (dc *Context) drawLine(l *Line, fromObject *Object) {
+	dc.drawLineWith(dc.Shader, l, fromObject)
+}
+
+// drawLineWith is drawLine running the vertex stage of vs.
+func (dc *Context) drawLineWith(vs Shader, l *Line, fromObject *Object) {
+	v1 := vs.Vertex(l.V1)
+	v2 := vs.Vertex(l.V2)
 
 	if v1.Outside() || v2.Outside() {
 		line := ClipLine(NewLine(v1, v2))
@@ -297,6 +559,7 @@ func (dc *Context) DrawLine(l *Line, fromObject *Object) {
 }
 
 func (dc *Context) DrawMesh(mesh *Mesh, fromObject *Object) {
+	dc.beginDraw(fromObject)
 	var wg sync.WaitGroup
 	// Use logical CPUs
 	wn := runtime.NumCPU()
@@ -306,10 +569,10 @@ func (dc *Context) DrawMesh(mesh *Mesh, fromObject *Object) {
 	for wi := 0; wi < wn; wi++ {
 		go func(wi int) {
 			for i := wi; i < len(mesh.Triangles); i += wn {
-				dc.DrawTriangle(mesh.Triangles[i], fromObject)
+				dc.drawTriangle(mesh.Triangles[i], i, fromObject)
 			}
 			for i := wi; i < len(mesh.Lines); i += wn {
-				dc.DrawLine(mesh.Lines[i], fromObject)
+				dc.drawLine(mesh.Lines[i], fromObject)
 			}
 			wg.Done()
 		}(wi)
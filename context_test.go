@@ -0,0 +1,41 @@
+package aeno
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestDrawTriangleConcurrent draws triangles from several goroutines, each
+// into its own quarter of the image; run with -race.
+func TestDrawTriangleConcurrent(t *testing.T) {
+	shader := NewPhongShader(Identity(), V(0, 0, 1), V(0, 0, 2), Gray(0.5), Gray(0.5))
+	dc := NewContext(32, 32, shader)
+	dc.ColorSpace = ColorSpaceSRGB
+	dc.EnableHDR()
+	dc.EnableTargets(TargetObject)
+	corners := []Vector{{-0.5, -0.5, 0}, {0.5, -0.5, 0}, {-0.5, 0.5, 0}, {0.5, 0.5, 0}}
+	var wg sync.WaitGroup
+	for _, c := range corners {
+		mesh := NewPlane()
+		mesh.Transform(Translate(c))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o := NewObject(mesh)
+			for i := 0; i < 50; i++ {
+				for _, tri := range mesh.Triangles {
+					dc.DrawTriangle(tri, o)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, p := range [][2]int{{8, 8}, {24, 8}, {8, 24}, {24, 24}} {
+		if c := MakeColor(dc.Image().At(p[0], p[1])); c.A == 0 {
+			t.Errorf("pixel %v not drawn", p)
+		}
+		if id := dc.ObjectBuffer[p[1]*32+p[0]]; dc.ObjectForID(id) == nil {
+			t.Errorf("pixel %v has object ID %d", p, id)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package aeno
+
+// ContextTexture is a Texture that samples the color buffer of a Context,
+// so a rendered image can be mapped onto objects in another render. It
+// holds a filtered, mipmapped copy of the buffer taken by Update; call
+// Update again after rendering a new frame into the Context.
+type ContextTexture struct {
+	*ImageTexture
+	Context *Context
+}
+
+// NewContextTexture returns a texture over the current contents of dc. It
+// clamps to the edges and uses trilinear filtering.
+func NewContextTexture(dc *Context) *ContextTexture {
+	t := &ContextTexture{
+		ImageTexture: &ImageTexture{
+			WrapS:     WrapClampToEdge,
+			WrapT:     WrapClampToEdge,
+			MagFilter: FilterLinear,
+			MinFilter: FilterLinearMipmapLinear,
+		},
+		Context: dc,
+	}
+	t.Update()
+	return t
+}
+
+// Update resolves the Context and copies its color buffer into the
+// texture, rebuilding the mip chain.
+func (t *ContextTexture) Update() {
+	im := t.Context.Image()
+	t.Image = im
+	t.Width = im.Bounds().Dx()
+	t.Height = im.Bounds().Dy()
+	t.GenerateMipmaps()
+}
@@ -0,0 +1,53 @@
+package aeno
+
+// ViewFrustum is a view volume bounded by six planes. Each plane is stored
+// as (a, b, c, d) with a*x + b*y + c*z + d >= 0 for points inside.
+type ViewFrustum struct {
+	Planes [6]VectorW
+}
+
+// NewViewFrustum extracts the frustum of a view-projection matrix, clipping
+// to -w <= x, y, z <= w like the rasterizer does.
+func NewViewFrustum(m Matrix) ViewFrustum {
+	r0 := VectorW{m.X00, m.X01, m.X02, m.X03}
+	r1 := VectorW{m.X10, m.X11, m.X12, m.X13}
+	r2 := VectorW{m.X20, m.X21, m.X22, m.X23}
+	r3 := VectorW{m.X30, m.X31, m.X32, m.X33}
+	return ViewFrustum{[6]VectorW{
+		r3.Add(r0), r3.Sub(r0),
+		r3.Add(r1), r3.Sub(r1),
+		r3.Add(r2), r3.Sub(r2),
+	}}
+}
+
+// ContainsPoint reports whether p is inside the frustum.
+func (f ViewFrustum) ContainsPoint(p Vector) bool {
+	for _, q := range f.Planes {
+		if q.X*p.X+q.Y*p.Y+q.Z*p.Z+q.W < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// IntersectsBox reports whether the box may be visible. It is conservative:
+// boxes near a frustum corner can pass without actually intersecting.
+func (f ViewFrustum) IntersectsBox(b Box) bool {
+	for _, q := range f.Planes {
+		// Test the corner furthest along the plane normal.
+		p := b.Min
+		if q.X >= 0 {
+			p.X = b.Max.X
+		}
+		if q.Y >= 0 {
+			p.Y = b.Max.Y
+		}
+		if q.Z >= 0 {
+			p.Z = b.Max.Z
+		}
+		if q.X*p.X+q.Y*p.Y+q.Z*p.Z+q.W < 0 {
+			return false
+		}
+	}
+	return true
+}
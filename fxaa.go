@@ -0,0 +1,219 @@
+package aeno
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	fxaaEdgeThresholdMin = 0.0312
+	fxaaEdgeThresholdMax = 0.125
+	fxaaSubpixelQuality  = 0.75
+	fxaaIterations       = 12
+)
+
+// fxaaQuality is the step multiplier used for each edge search iteration.
+var fxaaQuality = [fxaaIterations]float64{1, 1, 1, 1, 1, 1.5, 2, 2, 2, 2, 4, 8}
+
+// FXAA applies fast approximate anti-aliasing to ColorBuffer in place. It
+// is a cheap alternative to MSAA or supersampling that works on the final
+// image, so it should run after all drawing is done.
+func (dc *Context) FXAA() {
+	dc.Resolve()
+	copy(dc.ColorBuffer.Pix, FXAA(dc.ColorBuffer).Pix)
+}
+
+// FXAA returns an anti-aliased copy of src using the FXAA 3.11 quality
+// algorithm. Edges against transparent pixels are detected as well, so
+// images rendered over a transparent background are handled.
+func FXAA(src *image.NRGBA) *image.NRGBA {
+	b := src.Bounds()
+	f := newFloatImage(src)
+	luma := make([]float64, f.w*f.h)
+	for i := range luma {
+		p := f.pix[i*4 : i*4+4]
+		// Luma of the color composited over mid gray, so that alpha edges
+		// count as contrast too.
+		luma[i] = 0.299*p[0] + 0.587*p[1] + 0.114*p[2] + 0.5*(1-p[3])
+	}
+
+	dst := image.NewNRGBA(b)
+	parallel(f.h, func(y int) {
+		for x := 0; x < f.w; x++ {
+			c := fxaaPixel(f, luma, x, y)
+			dst.SetNRGBA(b.Min.X+x, b.Min.Y+y, c.unpremultiply().NRGBA())
+		}
+	})
+	return dst
+}
+
+func fxaaPixel(f *floatImage, luma []float64, x, y int) Color {
+	at := func(x, y int) float64 {
+		return luma[ClampInt(y, 0, f.h-1)*f.w+ClampInt(x, 0, f.w-1)]
+	}
+	lumaAt := func(x, y float64) float64 {
+		return bilinearFloats(luma, f.w, f.h, 1, x, y)[0]
+	}
+
+	lC := at(x, y)
+	lU := at(x, y-1)
+	lD := at(x, y+1)
+	lL := at(x-1, y)
+	lR := at(x+1, y)
+	lMin := math.Min(lC, math.Min(math.Min(lU, lD), math.Min(lL, lR)))
+	lMax := math.Max(lC, math.Max(math.Max(lU, lD), math.Max(lL, lR)))
+	lRange := lMax - lMin
+	if lRange < math.Max(fxaaEdgeThresholdMin, lMax*fxaaEdgeThresholdMax) {
+		return f.at(x, y)
+	}
+
+	lUL := at(x-1, y-1)
+	lUR := at(x+1, y-1)
+	lDL := at(x-1, y+1)
+	lDR := at(x+1, y+1)
+	lUD := lU + lD
+	lLR := lL + lR
+	lLeftCorners := lUL + lDL
+	lDownCorners := lDL + lDR
+	lRightCorners := lUR + lDR
+	lUpCorners := lUL + lUR
+
+	edgeH := math.Abs(-2*lL+lLeftCorners) + 2*math.Abs(-2*lC+lUD) + math.Abs(-2*lR+lRightCorners)
+	edgeV := math.Abs(-2*lU+lUpCorners) + 2*math.Abs(-2*lC+lLR) + math.Abs(-2*lD+lDownCorners)
+	horizontal := edgeH >= edgeV
+
+	// Pick the side of the edge with the steepest gradient.
+	l1, l2 := lL, lR
+	if horizontal {
+		l1, l2 = lU, lD
+	}
+	g1 := l1 - lC
+	g2 := l2 - lC
+	gradScaled := 0.25 * math.Max(math.Abs(g1), math.Abs(g2))
+	step := 1.0
+	var lLocal float64
+	if math.Abs(g1) >= math.Abs(g2) {
+		step = -step
+		lLocal = 0.5 * (l1 + lC)
+	} else {
+		lLocal = 0.5 * (l2 + lC)
+	}
+
+	// Walk along the edge in both directions until its end is found.
+	cx, cy := float64(x)+0.5, float64(y)+0.5
+	ox, oy := 0.0, 1.0
+	if horizontal {
+		cy += step * 0.5
+		ox, oy = 1, 0
+	} else {
+		cx += step * 0.5
+	}
+	p1x, p1y := cx-ox, cy-oy
+	p2x, p2y := cx+ox, cy+oy
+	var end1, end2 float64
+	reached1, reached2 := false, false
+	for i := 0; i < fxaaIterations && !(reached1 && reached2); i++ {
+		if !reached1 {
+			end1 = lumaAt(p1x, p1y) - lLocal
+			reached1 = math.Abs(end1) >= gradScaled
+		}
+		if !reached2 {
+			end2 = lumaAt(p2x, p2y) - lLocal
+			reached2 = math.Abs(end2) >= gradScaled
+		}
+		q := fxaaQuality[i]
+		if !reached1 {
+			p1x -= ox * q
+			p1y -= oy * q
+		}
+		if !reached2 {
+			p2x += ox * q
+			p2y += oy * q
+		}
+	}
+
+	dist1 := cy - p1y
+	dist2 := p2y - cy
+	if horizontal {
+		dist1 = cx - p1x
+		dist2 = p2x - cx
+	}
+	end := end2
+	if dist1 < dist2 {
+		end = end1
+	}
+	offset := 0.0
+	if (end < 0) != (lC < lLocal) {
+		offset = 0.5 - math.Min(dist1, dist2)/(dist1+dist2)
+	}
+
+	// Subpixel anti-aliasing for thin features.
+	lAverage := (2*(lUD+lLR) + lLeftCorners + lRightCorners) / 12
+	sub := Clamp(math.Abs(lAverage-lC)/lRange, 0, 1)
+	sub = (-2*sub + 3) * sub * sub
+	offset = math.Max(offset, sub*sub*fxaaSubpixelQuality)
+
+	fx, fy := float64(x)+0.5, float64(y)+0.5
+	if horizontal {
+		fy += offset * step
+	} else {
+		fx += offset * step
+	}
+	p := bilinearFloats(f.pix, f.w, f.h, 4, fx, fy)
+	return Color{p[0], p[1], p[2], p[3]}
+}
+
+// floatImage is an image stored as premultiplied float64 RGBA, used by the
+// post-processing passes.
+type floatImage struct {
+	w, h int
+	pix  []float64
+}
+
+func newFloatImage(src *image.NRGBA) *floatImage {
+	b := src.Bounds()
+	f := &floatImage{b.Dx(), b.Dy(), make([]float64, b.Dx()*b.Dy()*4)}
+	for y := 0; y < f.h; y++ {
+		row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := 0; x < f.w; x++ {
+			i := (y*f.w + x) * 4
+			a := float64(row[x*4+3]) / 255
+			f.pix[i+0] = float64(row[x*4+0]) / 255 * a
+			f.pix[i+1] = float64(row[x*4+1]) / 255 * a
+			f.pix[i+2] = float64(row[x*4+2]) / 255 * a
+			f.pix[i+3] = a
+		}
+	}
+	return f
+}
+
+func (f *floatImage) at(x, y int) Color {
+	p := f.pix[(y*f.w+x)*4:]
+	return Color{p[0], p[1], p[2], p[3]}
+}
+
+// bilinearFloats samples an interleaved buffer with n channels at pixel
+// coordinates x, y (texel centers at half-integers), clamping to the edge.
+func bilinearFloats(buf []float64, w, h, n int, x, y float64) [4]float64 {
+	x -= 0.5
+	y -= 0.5
+	x0 := int(math.Floor(x))
+	y0 := int(math.Floor(y))
+	fx := x - float64(x0)
+	fy := y - float64(y0)
+	x1 := ClampInt(x0+1, 0, w-1)
+	y1 := ClampInt(y0+1, 0, h-1)
+	x0 = ClampInt(x0, 0, w-1)
+	y0 = ClampInt(y0, 0, h-1)
+	var r [4]float64
+	for c := 0; c < n; c++ {
+		c00 := buf[(y0*w+x0)*n+c]
+		c10 := buf[(y0*w+x1)*n+c]
+		c01 := buf[(y1*w+x0)*n+c]
+		c11 := buf[(y1*w+x1)*n+c]
+		top := c00 + (c10-c00)*fx
+		bottom := c01 + (c11-c01)*fx
+		r[c] = top + (bottom-top)*fy
+	}
+	return r
+}
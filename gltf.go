@@ -3,8 +3,10 @@ package aeno
 import (
 	"bytes"
 	"fmt"
+	"image"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/qmuntal/gltf"
 	"github.com/qmuntal/gltf/modeler"
@@ -93,6 +95,127 @@ func LoadGLTFFromReader(r io.Reader) (*Mesh, Matrix, error) {
 
 	return NewTriangleMesh(allTriangles), rootMatrix, nil
 }
+
+// LoadGLTFTexture loads the base color texture of the first material that
+// has one, with the glTF sampler's wrap and filter settings applied.
+// Relative image URIs are resolved against the directory of path.
+func LoadGLTFTexture(path string) (Texture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return loadGLTFTexture(file, filepath.Dir(path))
+}
+
+func LoadGLTFTextureFromBytes(b []byte) (Texture, error) {
+	return LoadGLTFTextureFromReader(bytes.NewReader(b))
+}
+
+// LoadGLTFTextureFromReader is like LoadGLTFTexture but only supports
+// images embedded in the file, either in a buffer view or a data URI.
+func LoadGLTFTextureFromReader(r io.Reader) (Texture, error) {
+	return loadGLTFTexture(r, "")
+}
+
+func loadGLTFTexture(r io.Reader, dir string) (Texture, error) {
+	doc := new(gltf.Document)
+	if err := gltf.NewDecoder(r).Decode(doc); err != nil {
+		return nil, fmt.Errorf("failed to decode GLTF: %v", err)
+	}
+	for _, material := range doc.Materials {
+		pbr := material.PBRMetallicRoughness
+		if pbr == nil || pbr.BaseColorTexture == nil {
+			continue
+		}
+		return readGLTFTexture(doc, pbr.BaseColorTexture.Index, dir)
+	}
+	return nil, fmt.Errorf("no base color texture found in gltf")
+}
+
+func readGLTFTexture(doc *gltf.Document, index int, dir string) (*ImageTexture, error) {
+	if index < 0 || index >= len(doc.Textures) {
+		return nil, fmt.Errorf("gltf texture %d out of range", index)
+	}
+	texture := doc.Textures[index]
+	if texture.Source == nil {
+		return nil, fmt.Errorf("gltf texture %d has no image source", index)
+	}
+	if int(*texture.Source) >= len(doc.Images) {
+		return nil, fmt.Errorf("gltf texture %d image %d out of range", index, *texture.Source)
+	}
+	if texture.Sampler != nil && int(*texture.Sampler) >= len(doc.Samplers) {
+		return nil, fmt.Errorf("gltf texture %d sampler %d out of range", index, *texture.Sampler)
+	}
+	img := doc.Images[*texture.Source]
+
+	var data []byte
+	var err error
+	switch {
+	case img.BufferView != nil:
+		if int(*img.BufferView) >= len(doc.BufferViews) {
+			return nil, fmt.Errorf("gltf image buffer view %d out of range", *img.BufferView)
+		}
+		data, err = modeler.ReadBufferView(doc, doc.BufferViews[*img.BufferView])
+	case img.IsEmbeddedResource():
+		data, err = img.MarshalData()
+	case dir != "":
+		data, err = os.ReadFile(filepath.Join(dir, img.URI))
+	default:
+		err = fmt.Errorf("external image %q cannot be resolved", img.URI)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gltf image: %v", err)
+	}
+
+	im, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode gltf image: %v", err)
+	}
+	t := NewImageTexture(im).(*ImageTexture)
+	if texture.Sampler != nil {
+		applyGLTFSampler(t, doc.Samplers[*texture.Sampler])
+	}
+	return t, nil
+}
+
+// applyGLTFSampler copies the wrap and filter modes of a glTF sampler onto
+// the texture. Undefined filters keep the texture defaults.
+func applyGLTFSampler(t *ImageTexture, s *gltf.Sampler) {
+	t.WrapS = gltfWrapMode(s.WrapS)
+	t.WrapT = gltfWrapMode(s.WrapT)
+	switch s.MagFilter {
+	case gltf.MagNearest:
+		t.MagFilter = FilterNearest
+	case gltf.MagLinear:
+		t.MagFilter = FilterLinear
+	}
+	switch s.MinFilter {
+	case gltf.MinNearest:
+		t.MinFilter = FilterNearest
+	case gltf.MinLinear:
+		t.MinFilter = FilterLinear
+	case gltf.MinNearestMipMapNearest:
+		t.MinFilter = FilterNearestMipmapNearest
+	case gltf.MinLinearMipMapNearest:
+		t.MinFilter = FilterLinearMipmapNearest
+	case gltf.MinNearestMipMapLinear:
+		t.MinFilter = FilterNearestMipmapLinear
+	case gltf.MinLinearMipMapLinear:
+		t.MinFilter = FilterLinearMipmapLinear
+	}
+}
+
+func gltfWrapMode(w gltf.WrappingMode) WrapMode {
+	switch w {
+	case gltf.WrapClampToEdge:
+		return WrapClampToEdge
+	case gltf.WrapMirroredRepeat:
+		return WrapMirroredRepeat
+	}
+	return WrapRepeat
+}
+
 func processGLTFNode(doc *gltf.Document, node *gltf.Node, parentTransform Matrix) []*Triangle {
 	var triangles []*Triangle
 
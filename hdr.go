@@ -0,0 +1,150 @@
+package aeno
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// ToneMapping selects the operator Resolve uses to map HDR values into the
+// displayable [0, 1] range.
+type ToneMapping int
+
+const (
+	_ ToneMapping = iota
+	// ToneMapNone clamps values to [0, 1].
+	ToneMapNone
+	// ToneMapReinhard applies x / (1 + x).
+	ToneMapReinhard
+	// ToneMapACES applies Narkowicz's fit of the ACES filmic curve.
+	ToneMapACES
+	// ToneMapExposure applies 1 - exp(-x).
+	ToneMapExposure
+)
+
+// Map tone maps a single linear channel value that has already been scaled
+// by the exposure.
+func (t ToneMapping) Map(x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	switch t {
+	case ToneMapReinhard:
+		x = x / (1 + x)
+	case ToneMapACES:
+		x = (x * (2.51*x + 0.03)) / (x*(2.43*x+0.59) + 0.14)
+	case ToneMapExposure:
+		x = 1 - math.Exp(-x)
+	}
+	return Clamp(x, 0, 1)
+}
+
+// EnableHDR allocates HDRBuffer, so that subsequent draws accumulate
+// unclamped floating-point color, and clears it with ClearColor.
+func (dc *Context) EnableHDR() {
+	dc.HDRBuffer = make([]float32, dc.Width*dc.Height*4)
+	dc.clearHDRBuffer(dc.ClearColor, 0, dc.Width*dc.Height)
+}
+
+// clearHDRBuffer clears the pixels with indexes in [i0, i1).
+func (dc *Context) clearHDRBuffer(c Color, i0, i1 int) {
+	fillPremultiplied(dc.HDRBuffer[i0*4:i1*4], dc.premultiplied(c))
+	setFlag(&dc.dirty)
+}
+
+// premultiplied converts a color to the premultiplied form stored in the
+// float buffers, decoding it to linear for ColorSpaceSRGB.
+func (dc *Context) premultiplied(c Color) [4]float32 {
+	if dc.ColorSpace == ColorSpaceSRGB {
+		c = c.Linear()
+	}
+	return premultiply(c)
+}
+
+func premultiply(c Color) [4]float32 {
+	a := Clamp(c.A, 0, 1)
+	return [4]float32{float32(c.R * a), float32(c.G * a), float32(c.B * a), float32(a)}
+}
+
+func fillPremultiplied(buf []float32, p [4]float32) {
+	for i := 0; i < len(buf); i += 4 {
+		copy(buf[i:i+4], p[:])
+	}
+}
+
+// blendPremultiplied blends a straight-alpha color over the premultiplied
+// value p, or replaces it when blend is false.
+func blendPremultiplied(p []float32, c Color, blend bool) {
+	a := float32(Clamp(c.A, 0, 1))
+	r, g, b := float32(c.R)*a, float32(c.G)*a, float32(c.B)*a
+	if blend && a < 1 {
+		k := 1 - a
+		p[0] = r + p[0]*k
+		p[1] = g + p[1]*k
+		p[2] = b + p[2]*k
+		p[3] = a + p[3]*k
+		return
+	}
+	p[0], p[1], p[2], p[3] = r, g, b, a
+}
+
+// Resolve produces ColorBuffer from the floating-point buffers: weighted
+// transparency is composited, MSAA samples are averaged, and HDRBuffer is
+// written out applying Exposure, the ToneMapping operator and, for
+// ColorSpaceSRGB, the sRGB encoding. It does nothing when none of these
+// buffers is in use or nothing was drawn since the last call. Image calls
+// it automatically.
+func (dc *Context) Resolve() {
+	if atomic.SwapInt32(&dc.dirty, 0) == 0 {
+		return
+	}
+	if atomic.SwapInt32(&dc.transparent, 0) != 0 {
+		parallel(dc.Height, dc.compositeRow)
+	}
+	if dc.HDRBuffer != nil || dc.sampleColor != nil {
+		parallel(dc.Height, dc.resolveRow)
+	}
+}
+
+func (dc *Context) resolveRow(y int) {
+	if dc.sampleColor != nil {
+		dc.resolveSamplesRow(y)
+		if dc.HDRBuffer == nil {
+			return
+		}
+	}
+	dc.resolveHDRRow(y)
+}
+
+// resolveHDRRow tone maps row y of HDRBuffer into ColorBuffer.
+func (dc *Context) resolveHDRRow(y int) {
+	buf := dc.HDRBuffer[y*dc.Width*4:]
+	for x := 0; x < dc.Width; x++ {
+		p := buf[x*4 : x*4+4]
+		c := Color{}
+		if a := float64(p[3]); a > 0 {
+			e := dc.Exposure / a
+			c = Color{
+				dc.ToneMapping.Map(float64(p[0]) * e),
+				dc.ToneMapping.Map(float64(p[1]) * e),
+				dc.ToneMapping.Map(float64(p[2]) * e),
+				a,
+			}
+		}
+		dc.storePixel(x, y, c)
+	}
+}
+
+// storePixel writes a straight-alpha color to ColorBuffer, encoding it to
+// sRGB for ColorSpaceSRGB.
+func (dc *Context) storePixel(x, y int, c Color) {
+	if dc.ColorSpace == ColorSpaceSRGB {
+		c = c.SRGB()
+	}
+	i := dc.ColorBuffer.PixOffset(x, y)
+	nrgba := c.NRGBA()
+	pix := dc.ColorBuffer.Pix
+	pix[i+0] = nrgba.R
+	pix[i+1] = nrgba.G
+	pix[i+2] = nrgba.B
+	pix[i+3] = nrgba.A
+}
@@ -0,0 +1,89 @@
+package aeno
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Instance is one copy of a mesh drawn by DrawMeshInstanced.
+type Instance struct {
+	Matrix Matrix
+	Color  Color
+}
+
+// matrixShader is implemented by shaders whose vertex stage applies a
+// Matrix, so instances can be drawn with a transformed copy of the shader
+// instead of a transformed copy of the mesh.
+type matrixShader interface {
+	withMatrix(m Matrix) Shader
+}
+
+// DrawMeshInstanced draws mesh once per instance, each with its own matrix
+// and color. Every instance gets its own Object, so they have separate
+// object IDs in ObjectBuffer. The Object of the i-th instance of a mesh is
+// reused by later calls, so it keeps its ID until the IDs are reset.
+// Triangles of all instances are rasterized in parallel.
+func (dc *Context) DrawMeshInstanced(mesh *Mesh, instances []Instance) {
+	if len(instances) == 0 {
+		return
+	}
+	dc.beginDraw(nil)
+
+	// Per-instance vertex shaders, or transformed meshes for shaders that
+	// cannot take a matrix.
+	objects := make([]*Object, len(instances))
+	shaders := make([]Shader, len(instances))
+	ms, ok := dc.Shader.(matrixShader)
+	for i, inst := range instances {
+		o := dc.instanceObject(mesh, i)
+		o.Mesh = mesh
+		o.Color = inst.Color
+		o.Matrix = inst.Matrix
+		shaders[i] = dc.Shader
+		if ok {
+			shaders[i] = ms.withMatrix(inst.Matrix)
+		} else {
+			o.Mesh = mesh.Copy()
+			o.Mesh.Transform(inst.Matrix)
+			o.Matrix = Identity()
+		}
+		dc.registerObject(o)
+		objects[i] = o
+	}
+
+	nt := len(mesh.Triangles)
+	nl := len(mesh.Lines)
+	n := len(instances) * (nt + nl)
+	var wg sync.WaitGroup
+	wn := runtime.NumCPU()
+	wg.Add(wn)
+	for wi := 0; wi < wn; wi++ {
+		go func(wi int) {
+			for k := wi; k < n; k += wn {
+				i, j := k/(nt+nl), k%(nt+nl)
+				o := objects[i]
+				if j < nt {
+					dc.drawTriangleWith(shaders[i], o.Mesh.Triangles[j], j, o)
+				} else {
+					dc.drawLineWith(shaders[i], o.Mesh.Lines[j-nt], o)
+				}
+			}
+			wg.Done()
+		}(wi)
+	}
+	wg.Wait()
+}
+
+// instanceObject returns the Object for instance i of mesh, creating it on
+// first use so that repeated draws do not grow the object ID registry.
+func (dc *Context) instanceObject(mesh *Mesh, i int) *Object {
+	if dc.instances == nil {
+		dc.instances = make(map[*Mesh][]*Object)
+	}
+	objects := dc.instances[mesh]
+	for len(objects) <= i {
+		objects = append(objects, NewObject(mesh))
+	}
+	dc.instances[mesh] = objects
+	return objects[i]
+}
@@ -11,6 +11,7 @@ type Mesh struct {
 	Triangles []*Triangle
 	Lines     []*Line
 	box       *Box
+	bvh       *BVH
 }
 
 // NewEmptyMesh returns an empty mesh
@@ -20,21 +21,22 @@ func NewEmptyMesh() *Mesh {
 
 // NewMesh returns a mesh with given data
 func NewMesh(triangles []*Triangle, lines []*Line) *Mesh {
-	return &Mesh{triangles, lines, nil}
+	return &Mesh{triangles, lines, nil, nil}
 }
 
 // NewTriangleMesh returns a mesh with given data
 func NewTriangleMesh(triangles []*Triangle) *Mesh {
-	return &Mesh{triangles, nil, nil}
+	return &Mesh{triangles, nil, nil, nil}
 }
 
 // NewLineMesh returns a mesh with given data
 func NewLineMesh(lines []*Line) *Mesh {
-	return &Mesh{nil, lines, nil}
+	return &Mesh{nil, lines, nil, nil}
 }
 
 func (m *Mesh) dirty() {
 	m.box = nil
+	m.bvh = nil
 }
 
 // Copy f
@@ -175,6 +177,15 @@ func (m *Mesh) BoundingBox() Box {
 	return *m.box
 }
 
+// BVH returns a BVH over the mesh triangles, built on first use and rebuilt
+// after the mesh is transformed or extended.
+func (m *Mesh) BVH() *BVH {
+	if m.bvh == nil {
+		m.bvh = NewBVH(m.Triangles)
+	}
+	return m.bvh
+}
+
 // Transform f
 func (m *Mesh) Transform(matrix Matrix) {
 	for _, t := range m.Triangles {
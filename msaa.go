@@ -0,0 +1,237 @@
+package aeno
+
+import "math"
+
+// samplePatterns holds the standard sample positions for each supported
+// sample count, as offsets from the pixel center in 1/16 pixel units.
+var samplePatterns = map[int][][2]float64{
+	2: {{4, 4}, {-4, -4}},
+	4: {{-2, -6}, {6, -2}, {-6, 2}, {2, 6}},
+	8: {{1, -3}, {-1, 3}, {5, 1}, {-3, -5}, {-5, 5}, {-7, -1}, {3, 7}, {7, -7}},
+}
+
+// EnableMSAA switches the Context to multisample anti-aliasing with the
+// given number of samples per pixel (2, 4 or 8; other values are rounded
+// down to a supported count, and 1 or less disables MSAA). Coverage and
+// depth are evaluated per sample while the fragment shader runs once per
+// pixel. Resolve averages the samples into ColorBuffer and DepthBuffer.
+func (dc *Context) EnableMSAA(samples int) {
+	switch {
+	case samples >= 8:
+		samples = 8
+	case samples >= 4:
+		samples = 4
+	case samples >= 2:
+		samples = 2
+	default:
+		dc.samples = 1
+		dc.sampleColor = nil
+		dc.sampleDepth = nil
+		return
+	}
+	dc.samples = samples
+	dc.sampleColor = make([]float32, dc.Width*dc.Height*samples*4)
+	dc.sampleDepth = make([]float64, dc.Width*dc.Height*samples)
+	dc.clearSampleColor(dc.ClearColor, 0, dc.Width*dc.Height)
+	for i := range dc.sampleDepth {
+		dc.sampleDepth[i] = math.MaxFloat64
+	}
+}
+
+// Samples returns the number of coverage samples per pixel set with
+// EnableMSAA, 1 when MSAA is off.
+func (dc *Context) Samples() int {
+	return dc.samples
+}
+
+// clearSampleColor clears the samples of the pixels with indexes in
+// [i0, i1).
+func (dc *Context) clearSampleColor(c Color, i0, i1 int) {
+	n := dc.samples
+	fillPremultiplied(dc.sampleColor[i0*n*4:i1*n*4], dc.premultiplied(c))
+	setFlag(&dc.dirty)
+}
+
+func (dc *Context) rasterizeMSAA(v0, v1, v2 Vertex, s0, s1, s2 Vector, tri int, fromObject *Object) {
+	n := dc.samples
+	pattern := samplePatterns[n]
+
+	min := s0.Min(s1.Min(s2)).Floor()
+	max := s0.Max(s1.Max(s2)).Ceil()
+
+	clip := dc.clipRect()
+	x0 := maxInt(int(min.X), clip.Min.X)
+	x1 := minInt(int(max.X), clip.Max.X-1)
+	y0 := maxInt(int(min.Y), clip.Min.Y)
+	y1 := minInt(int(max.Y), clip.Max.Y-1)
+	if x0 > x1 || y0 > y1 {
+		return
+	}
+
+	p := Vector{float64(x0) + 0.5, float64(y0) + 0.5, 0}
+	w00 := edge(s1, s2, p)
+	w01 := edge(s2, s0, p)
+	w02 := edge(s0, s1, p)
+	a01 := s1.Y - s0.Y
+	b01 := s0.X - s1.X
+	a12 := s2.Y - s1.Y
+	b12 := s1.X - s2.X
+	a20 := s0.Y - s2.Y
+	b20 := s2.X - s0.X
+
+	ra := 1 / edge(s0, s1, s2)
+	r0 := 1 / v0.Output.W
+	r1 := 1 / v1.Output.W
+	r2 := 1 / v2.Output.W
+
+	gs, grad := dc.Shader.(GradientShader)
+	stencil := dc.stencilEnabled()
+	var depths [8]float64
+
+	for y := y0; y <= y1; y++ {
+		w0 := w00
+		w1 := w01
+		w2 := w02
+		for x := x0; x <= x1; x++ {
+			i := y*dc.Width + x
+
+			// Coverage and early depth test per sample
+			var mask, coverage uint
+			var sw0, sw1, sw2 float64
+			for k, o := range pattern {
+				ox, oy := o[0]/16, o[1]/16
+				e0 := w0 + a12*ox + b12*oy
+				e1 := w1 + a20*ox + b20*oy
+				e2 := w2 + a01*ox + b01*oy
+				b0, b1, b2 := e0*ra, e1*ra, e2*ra
+				if b0 < 0 || b1 < 0 || b2 < 0 {
+					continue
+				}
+				coverage |= 1 << uint(k)
+				z := b0*s0.Z + b1*s1.Z + b2*s2.Z
+				if dc.ReadDepth && z+dc.DepthBias > dc.sampleDepth[i*n+k] {
+					continue
+				}
+				if mask == 0 {
+					sw0, sw1, sw2 = e0, e1, e2
+				}
+				depths[k] = z
+				mask |= 1 << uint(k)
+			}
+			if stencil && coverage != 0 && dc.stencilReject(x, y, i, mask != 0) {
+				mask = 0
+			}
+			if mask != 0 {
+				// Shade at the pixel center when it is covered, otherwise
+				// at the first covered sample.
+				if w0*ra >= 0 && w1*ra >= 0 && w2*ra >= 0 {
+					sw0, sw1, sw2 = w0, w1, w2
+				}
+				b := VectorW{sw0 * ra * r0, sw1 * ra * r1, sw2 * ra * r2, 0}
+				b.W = 1 / (b.X + b.Y + b.Z)
+				v := InterpolateVertexes(v0, v1, v2, b)
+
+				var colorVal Color
+				if grad {
+					t0, t1, t2 := v0.Texture, v1.Texture, v2.Texture
+					dx := textureAt(t0, t1, t2, r0, r1, r2, sw0+a12, sw1+a20, sw2+a01).Sub(v.Texture)
+					dy := textureAt(t0, t1, t2, r0, r1, r2, sw0+b12, sw1+b20, sw2+b01).Sub(v.Texture)
+					colorVal = gs.FragmentGrad(v, dx, dy, fromObject)
+				} else {
+					colorVal = dc.Shader.Fragment(v, fromObject)
+				}
+
+				if colorVal.A > 0 {
+					lock := &dc.locks[(x+y)&255]
+					lock.Lock()
+					if dc.weighted(colorVal) {
+						covered, z := 0, math.MaxFloat64
+						for k := 0; k < n; k++ {
+							if mask&(1<<uint(k)) == 0 {
+								continue
+							}
+							if dc.ReadDepth && depths[k]+dc.DepthBias > dc.sampleDepth[i*n+k] {
+								continue
+							}
+							covered++
+							z = math.Min(z, depths[k])
+						}
+						if covered > 0 && dc.stencilPass(i) && dc.WriteColor {
+							dc.accumulate(i, colorVal, z, float64(covered)/float64(n))
+						}
+					} else if dc.stencilPass(i) {
+						dc.writeSamples(i, mask, depths[:], v, colorVal, tri, fromObject)
+					}
+					lock.Unlock()
+				}
+			}
+			w0 += a12
+			w1 += a20
+			w2 += a01
+		}
+		w00 += b12
+		w01 += b20
+		w02 += b01
+	}
+}
+
+// writeSamples writes an opaque or blended fragment to the covered samples
+// of pixel i that pass the depth test.
+func (dc *Context) writeSamples(i int, mask uint, depths []float64, v Vertex, colorVal Color, tri int, fromObject *Object) {
+	n := dc.samples
+	wrote := false
+	for k := 0; k < n; k++ {
+		if mask&(1<<uint(k)) == 0 {
+			continue
+		}
+		j := i*n + k
+		if dc.ReadDepth && depths[k]+dc.DepthBias > dc.sampleDepth[j] {
+			continue
+		}
+		if dc.WriteDepth {
+			dc.sampleDepth[j] = depths[k]
+			wrote = true
+		}
+		if dc.WriteColor {
+			blendPremultiplied(dc.sampleColor[j*4:j*4+4], colorVal, dc.AlphaBlend)
+		}
+	}
+	if wrote {
+		dc.writeTargets(i, v, tri, fromObject)
+	}
+}
+
+// resolveSamplesRow averages the samples of row y. The result goes to
+// HDRBuffer when there is one and straight to ColorBuffer otherwise. The
+// nearest sample depth is copied to DepthBuffer.
+func (dc *Context) resolveSamplesRow(y int) {
+	n := dc.samples
+	inv := 1 / float32(n)
+	for x := 0; x < dc.Width; x++ {
+		i := y*dc.Width + x
+		var sum [4]float32
+		depth := math.MaxFloat64
+		for k := 0; k < n; k++ {
+			j := i*n + k
+			p := dc.sampleColor[j*4 : j*4+4]
+			sum[0] += p[0]
+			sum[1] += p[1]
+			sum[2] += p[2]
+			sum[3] += p[3]
+			depth = math.Min(depth, dc.sampleDepth[j])
+		}
+		dc.DepthBuffer[i] = depth
+		for c := range sum {
+			sum[c] *= inv
+		}
+		if dc.HDRBuffer != nil {
+			copy(dc.HDRBuffer[i*4:i*4+4], sum[:])
+			continue
+		}
+		c := Color{}
+		if a := float64(sum[3]); a > 0 {
+			c = Color{float64(sum[0]) / a, float64(sum[1]) / a, float64(sum[2]) / a, a}
+		}
+		dc.storePixel(x, y, c)
+	}
+}
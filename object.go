@@ -8,6 +8,17 @@ type Object struct {
 	Color          Color
 	Matrix         Matrix
 	UseVertexColor bool
+	// Emissive is linear light added on top of the shaded color. Values
+	// above 1 only survive when the Context has an HDR buffer.
+	Emissive Color
+	// MaterialID is written to the Context MaterialBuffer.
+	MaterialID int32
+	// Specular and Roughness describe the glossy layer the PathTracer
+	// puts over the diffuse color. Specular is its reflectance at normal
+	// incidence, 0 for a purely diffuse surface and 1 for a mirror-like
+	// one. Roughness goes from a sharp reflection at 0 to a broad one at 1.
+	Specular  float64
+	Roughness float64
 }
 
 func NewObject(mesh *Mesh) *Object {
@@ -36,6 +47,18 @@ func NewObjectFromURL(url string) *Object {
 	return NewObject(mesh)
 }
 
+// Transparent reports whether the object's color or texture has alpha
+// below 1.
+func (o *Object) Transparent() bool {
+	if o.Color.A < 1 {
+		return true
+	}
+	if t, ok := o.Texture.(interface{ Opaque() bool }); ok {
+		return !t.Opaque()
+	}
+	return false
+}
+
 func (o *Object) SetColor(c Color) {
 	o.Color = c
 }
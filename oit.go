@@ -0,0 +1,94 @@
+package aeno
+
+import "math"
+
+// Transparency selects how a Context composites translucent fragments.
+type Transparency int
+
+const (
+	_ Transparency = iota
+	// TransparencyBlend blends each fragment into the color buffer as it is
+	// drawn, so overlapping translucent triangles depend on draw order.
+	TransparencyBlend
+	// TransparencyWeighted uses weighted blended order-independent
+	// transparency: fragments with alpha below 1 are depth tested but do
+	// not write depth, and are accumulated with a depth based weight and
+	// composited over the opaque result by Resolve. The result does not
+	// depend on draw order, but opaque geometry must be drawn first.
+	TransparencyWeighted
+)
+
+// weighted reports whether c goes to the transparency accumulation buffers.
+func (dc *Context) weighted(c Color) bool {
+	return dc.Transparency == TransparencyWeighted && dc.AlphaBlend && c.A < 1
+}
+
+// clearTransparency clears the pixels with indexes in [i0, i1).
+func (dc *Context) clearTransparency(i0, i1 int) {
+	for i := i0 * 4; i < i1*4; i++ {
+		dc.oitAccum[i] = 0
+	}
+	for i := i0; i < i1; i++ {
+		dc.oitReveal[i] = 1
+	}
+}
+
+// accumulate adds a translucent fragment at depth z covering the given
+// fraction of pixel i. The caller holds the pixel lock.
+func (dc *Context) accumulate(i int, c Color, z, coverage float64) {
+	a := Clamp(c.A, 0, 1) * coverage
+	// McGuire and Bavoil's weight, favoring fragments near the camera. The
+	// color is accumulated premultiplied, as (C*a, a)*w.
+	w := a * Clamp(3e3*math.Pow(1-z, 3), 1e-2, 3e3)
+	p := dc.oitAccum[i*4 : i*4+4]
+	p[0] += c.R * a * w
+	p[1] += c.G * a * w
+	p[2] += c.B * a * w
+	p[3] += a * w
+	dc.oitReveal[i] *= 1 - a
+}
+
+// compositeRow composites the accumulated translucent fragments of row y
+// over the opaque color, in whichever buffer holds it, and clears them.
+func (dc *Context) compositeRow(y int) {
+	n := dc.samples
+	for x := 0; x < dc.Width; x++ {
+		i := y*dc.Width + x
+		r := dc.oitReveal[i]
+		if r >= 1 {
+			continue
+		}
+		p := dc.oitAccum[i*4 : i*4+4]
+		k := (1 - r) / math.Max(p[3], 1e-5)
+		t := [4]float64{p[0] * k, p[1] * k, p[2] * k, 1 - r}
+		over := func(d []float32) {
+			for c := range t {
+				d[c] = float32(t[c] + float64(d[c])*r)
+			}
+		}
+		switch {
+		case dc.sampleColor != nil:
+			for j := i * n; j < i*n+n; j++ {
+				over(dc.sampleColor[j*4 : j*4+4])
+			}
+		case dc.HDRBuffer != nil:
+			over(dc.HDRBuffer[i*4 : i*4+4])
+		default:
+			o := dc.ColorBuffer.PixOffset(x, y)
+			px := dc.ColorBuffer.Pix[o : o+4]
+			dst := Color{float64(px[0]) / 255, float64(px[1]) / 255, float64(px[2]) / 255, float64(px[3]) / 255}
+			if dc.ColorSpace == ColorSpaceSRGB {
+				dst = dst.Linear()
+			}
+			d := premultiply(dst)
+			over(d[:])
+			c := Color{}
+			if a := float64(d[3]); a > 0 {
+				c = Color{float64(d[0]) / a, float64(d[1]) / a, float64(d[2]) / a, a}
+			}
+			dc.storePixel(x, y, c)
+		}
+		p[0], p[1], p[2], p[3] = 0, 0, 0, 0
+		dc.oitReveal[i] = 1
+	}
+}
@@ -0,0 +1,37 @@
+package aeno
+
+import "testing"
+
+// renderTranslucentQuad draws one 50% red quad over black and returns the
+// color of the center pixel.
+func renderTranslucentQuad(transparency Transparency, hdr bool) Color {
+	shader := NewSolidColorShader(Identity(), Color{1, 0, 0, 0.5}, 0)
+	dc := NewContext(8, 8, shader)
+	dc.Cull = CullNone
+	dc.Transparency = transparency
+	dc.ClearColor = Black
+	if hdr {
+		dc.ToneMapping = ToneMapNone
+		dc.EnableHDR()
+	}
+	dc.ClearColorBufferWith(Black)
+	dc.ClearDepthBuffer()
+	mesh := NewPlane()
+	mesh.Transform(Scale(V(2, 2, 1)))
+	dc.DrawMesh(mesh, NewObject(mesh))
+	return MakeColor(dc.Image().At(4, 4))
+}
+
+func TestWeightedTransparencySingleLayer(t *testing.T) {
+	for _, hdr := range []bool{false, true} {
+		blend := renderTranslucentQuad(TransparencyBlend, hdr)
+		weighted := renderTranslucentQuad(TransparencyWeighted, hdr)
+		if blend.R < 0.45 || blend.R > 0.55 {
+			t.Fatalf("hdr=%v: blended red = %v, want about 0.5", hdr, blend.R)
+		}
+		const eps = 1.0 / 255
+		if d := weighted.Sub(blend); d.R > eps || d.R < -eps || d.A > eps || d.A < -eps {
+			t.Errorf("hdr=%v: weighted = %v, blended = %v", hdr, weighted, blend)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package aeno
+
+import "math"
+
+// Outline is a post pass that draws lines where the depth or the normal of
+// the rendered surfaces changes abruptly, giving consistent silhouettes and
+// crease lines for every object in the image. Normal edges require the
+// Context NormalBuffer; without it only depth edges are found.
+type Outline struct {
+	// Width is the line width in pixels.
+	Width float64
+	Color Color
+	// DepthThreshold is the minimum depth jump, relative to the distance
+	// from the camera, that counts as an edge (0.002 is 0.2%).
+	DepthThreshold float64
+	// NormalThreshold is the minimum 1 - dot(n1, n2) between neighboring
+	// normals to count as an edge.
+	NormalThreshold float64
+}
+
+// NewOutline returns an Outline with thresholds suited to most scenes.
+func NewOutline(width float64, color Color) Outline {
+	return Outline{
+		Width:           width,
+		Color:           color,
+		DepthThreshold:  0.002,
+		NormalThreshold: 0.4,
+	}
+}
+
+// Apply f
+func (p Outline) Apply(dc *Context) {
+	dc.Resolve()
+	edges := dc.outlineEdges(p.DepthThreshold, p.NormalThreshold)
+
+	// Odd widths center the brush on the edge pixel. Even widths center it
+	// on a pixel corner, so they cover one more pixel across than the odd
+	// width below them.
+	r := math.Max((p.Width-1)/2, 0)
+	o := 0.0
+	if n := int(math.Round(p.Width)); n >= 2 && n%2 == 0 {
+		o = 0.5
+	}
+	ri := int(math.Ceil(r + o))
+	color := p.Color
+	parallel(dc.Height, func(y int) {
+		for x := 0; x < dc.Width; x++ {
+			// Dilate the one pixel edges to the requested width.
+			hit := false
+			for dy := -ri; dy <= ri && !hit; dy++ {
+				for dx := -ri; dx <= ri && !hit; dx++ {
+					ox, oy := float64(dx)+o, float64(dy)+o
+					if ox*ox+oy*oy > r*r+0.5 {
+						continue
+					}
+					sx, sy := x+dx, y+dy
+					if sx >= 0 && sy >= 0 && sx < dc.Width && sy < dc.Height {
+						hit = edges[sy*dc.Width+sx]
+					}
+				}
+			}
+			if !hit {
+				continue
+			}
+			i := dc.ColorBuffer.PixOffset(x, y)
+			px := dc.ColorBuffer.Pix[i : i+4]
+			dst := Color{float64(px[0]) / 255, float64(px[1]) / 255, float64(px[2]) / 255, float64(px[3]) / 255}
+			a := color.A + dst.A*(1-color.A)
+			if a <= 0 {
+				continue
+			}
+			c := color.MulScalar(color.A).Add(dst.MulScalar(dst.A * (1 - color.A))).DivScalar(a).Alpha(a)
+			nrgba := c.NRGBA()
+			px[0], px[1], px[2], px[3] = nrgba.R, nrgba.G, nrgba.B, nrgba.A
+		}
+	})
+}
+
+// outlineEdges marks the pixels on the near side of depth and normal
+// discontinuities.
+func (dc *Context) outlineEdges(depthThreshold, normalThreshold float64) []bool {
+	w, h := dc.Width, dc.Height
+	depth := dc.DepthBuffer
+	normals := dc.NormalBuffer
+	empty := func(d float64) bool {
+		return d == math.MaxFloat64
+	}
+	edges := make([]bool, w*h)
+	parallel(h, func(y int) {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			dC := depth[i]
+			if empty(dC) {
+				continue
+			}
+			l, r := ClampInt(x-1, 0, w-1)+y*w, ClampInt(x+1, 0, w-1)+y*w
+			u, d := ClampInt(y-1, 0, h-1)*w+x, ClampInt(y+1, 0, h-1)*w+x
+			edge := false
+			for _, pair := range [2][2]int{{l, r}, {u, d}} {
+				d0, d1 := depth[pair[0]], depth[pair[1]]
+				if empty(d0) || empty(d1) {
+					edge = true
+					break
+				}
+				// Depth is affine in screen space across a plane, so the
+				// second derivative only picks up jumps and creases. For
+				// perspective depth, a jump divided by 1 - depth is about
+				// the jump in view distance relative to that distance.
+				// Requiring it to also beat the slope rejects steep
+				// curved surfaces near silhouettes.
+				lap := d0 + d1 - 2*dC
+				slope := math.Abs(d1-d0) / 2
+				if lap > depthThreshold*(1-dC) && lap > slope {
+					edge = true
+					break
+				}
+			}
+			if !edge && normals != nil {
+				for _, j := range [4]int{l, r, u, d} {
+					if j != i && dC <= depth[j] && 1-normals[i].Dot(normals[j]) > normalThreshold {
+						edge = true
+						break
+					}
+				}
+			}
+			edges[i] = edge
+		}
+	})
+	return edges
+}
@@ -0,0 +1,25 @@
+package aeno
+
+import "testing"
+
+func TestOutlineWidth(t *testing.T) {
+	mesh := NewPlane()
+	prev := 0
+	for _, width := range []float64{1, 2, 3, 4, 5} {
+		dc := NewContext(64, 64, NewSolidColorShader(Identity(), White, 0))
+		dc.ClearColorBufferWith(Black)
+		dc.ClearDepthBuffer()
+		dc.DrawMesh(mesh, NewObject(mesh))
+		NewOutline(width, Color{1, 0, 0, 1}).Apply(dc)
+		n := 0
+		for i := 0; i < len(dc.ColorBuffer.Pix); i += 4 {
+			if dc.ColorBuffer.Pix[i] == 255 && dc.ColorBuffer.Pix[i+1] == 0 {
+				n++
+			}
+		}
+		if n <= prev {
+			t.Errorf("width %v covers %d pixels, not more than the width below", width, n)
+		}
+		prev = n
+	}
+}
@@ -0,0 +1,485 @@
+package aeno
+
+import (
+	"errors"
+	"image"
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+// PathTracer renders a Scene by tracing light paths on the CPU, as an
+// alternative to rasterizing it. It uses the Scene objects and Camera, or
+// the matrix of the Context shader when there is no Camera, and writes the
+// image into the Context buffers. Each Render call adds Samples paths per
+// pixel to a running average, so the image converges over repeated calls.
+//
+// Surfaces have a diffuse layer colored as PhongShader colors them, under
+// a glossy layer set by Object.Specular and Object.Roughness, and emit
+// Object.Emissive. Light from emissive objects and the sun is sampled
+// directly at every bounce and combined with the bounce rays by multiple
+// importance sampling. Alpha below 1 lets paths through stochastically.
+type PathTracer struct {
+	Scene *Scene
+	// Samples is the number of paths per pixel traced by each Render.
+	Samples int
+	// MaxBounces limits the path length. Paths may end earlier through
+	// Russian roulette.
+	MaxBounces int
+	// Seed makes renders repeatable: every pixel and sample draws from its
+	// own random sequence derived from it, whatever the scheduling.
+	Seed int64
+	// Sky is the light arriving from every direction that leaves the
+	// scene. Camera rays that miss show the Context ClearColor instead.
+	Sky Color
+	// SunDirection points towards a directional light. SunColor is the
+	// light a white diffuse surface facing it reflects; black disables it.
+	SunDirection Vector
+	SunColor     Color
+	accum        []Color
+	count        int
+}
+
+// NewPathTracer returns a PathTracer for the scene. When the Context shader
+// is a PhongShader, its ambient color becomes the sky and its light
+// direction and diffuse color the sun.
+func NewPathTracer(scene *Scene) *PathTracer {
+	pt := &PathTracer{Scene: scene, Samples: 16, MaxBounces: 6}
+	if phong, ok := scene.Context.Shader.(*PhongShader); ok {
+		pt.Sky = phong.AmbientColor
+		pt.SunDirection = phong.LightDirection
+		pt.SunColor = phong.DiffuseColor
+	}
+	return pt
+}
+
+// SampleCount returns the number of paths per pixel accumulated so far.
+func (pt *PathTracer) SampleCount() int {
+	return pt.count
+}
+
+// Reset discards the accumulated samples. Call it after changing the
+// scene, the camera or the PathTracer settings.
+func (pt *PathTracer) Reset() {
+	pt.accum = nil
+	pt.count = 0
+}
+
+var errNoCamera = errors.New("aeno: path tracing needs a shader with a view-projection matrix")
+
+// Render traces Samples more paths through every pixel of the Viewport,
+// limited by the Scissor, and writes the average of all paths so far to
+// HDRBuffer when there is one and to ColorBuffer. Only color is written.
+func (pt *PathTracer) Render() error {
+	pt.Scene.applyCamera()
+	dc := pt.Scene.Context
+	vs, ok := dc.Shader.(viewShader)
+	if !ok {
+		return errNoCamera
+	}
+	if len(pt.accum) != dc.Width*dc.Height {
+		pt.accum = make([]Color, dc.Width*dc.Height)
+		pt.count = 0
+	}
+	inv := dc.viewportMatrix().Mul(vs.viewProjection()).Inverse()
+	s := pt.prepare()
+	r := dc.clipRect()
+	if !dc.Viewport.Empty() {
+		r = r.Intersect(dc.Viewport)
+	}
+	n := maxInt(pt.Samples, 1)
+	parallel(r.Dy(), func(j int) {
+		y := r.Min.Y + j
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := y*dc.Width + x
+			sum := pt.accum[i]
+			for k := 0; k < n; k++ {
+				rnd := newPTRand(pt.Seed, x, y, pt.count+k)
+				ray := unproject(inv, float64(x)+rnd.float(), float64(y)+rnd.float())
+				if c, ok := s.trace(ray, &rnd); ok {
+					sum = sum.Add(c.Alpha(1))
+				}
+			}
+			pt.accum[i] = sum
+		}
+	})
+	pt.count += n
+	pt.write(r)
+	return nil
+}
+
+// write composites the averaged paths over ClearColor and stores them.
+func (pt *PathTracer) write(r image.Rectangle) {
+	dc := pt.Scene.Context
+	bg := dc.premultiplied(dc.ClearColor)
+	n := float64(pt.count)
+	parallel(r.Dy(), func(j int) {
+		y := r.Min.Y + j
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := y*dc.Width + x
+			c := pt.accum[i].DivScalar(n)
+			k := float32(1 - c.A)
+			p := [4]float32{
+				float32(c.R) + bg[0]*k,
+				float32(c.G) + bg[1]*k,
+				float32(c.B) + bg[2]*k,
+				float32(c.A) + bg[3]*k,
+			}
+			if dc.HDRBuffer != nil {
+				copy(dc.HDRBuffer[i*4:i*4+4], p[:])
+				continue
+			}
+			straight := Color{float64(p[0]), float64(p[1]), float64(p[2]), float64(p[3])}
+			dc.storePixel(x, y, straight.unpremultiply().Min(White))
+		}
+		if dc.HDRBuffer != nil {
+			dc.resolveHDRRow(y)
+		}
+	})
+	atomic.StoreInt32(&dc.dirty, 0)
+	atomic.StoreInt32(&dc.transparent, 0)
+}
+
+// ptObject is a scene object prepared for tracing.
+type ptObject struct {
+	object  *Object
+	bvh     *BVH
+	inverse Matrix
+	normal  Matrix
+	box     Box
+}
+
+// ptEmitter is a world-space triangle of an emissive object.
+type ptEmitter struct {
+	a, e1, e2 Vector
+	object    int
+}
+
+// ptScene holds what a Render needs, read-only while tracing.
+type ptScene struct {
+	objects    []ptObject
+	emitters   []ptEmitter
+	cdf        []float64
+	power      float64
+	sky        Color
+	sun        Vector
+	sunColor   Color
+	maxBounces int
+	linear     bool
+	eps        float64
+}
+
+func (pt *PathTracer) prepare() *ptScene {
+	s := &ptScene{
+		sky:        pt.Sky,
+		sun:        pt.SunDirection.Normalize(),
+		sunColor:   pt.SunColor,
+		maxBounces: pt.MaxBounces,
+		linear:     pt.Scene.Context.ColorSpace == ColorSpaceSRGB,
+	}
+	var extent float64
+	for _, o := range pt.Scene.Objects {
+		if o.Mesh == nil || len(o.Mesh.Triangles) == 0 {
+			continue
+		}
+		inv := o.Matrix.Inverse()
+		box := o.Matrix.MulBox(o.Mesh.BoundingBox())
+		s.objects = append(s.objects, ptObject{o, o.Mesh.BVH(), inv, inv.Transpose(), box})
+		extent = math.Max(extent, box.Min.Abs().Max(box.Max.Abs()).MaxComponent())
+		l := luminance(o.Emissive)
+		if l <= 0 {
+			continue
+		}
+		for _, t := range o.Mesh.Triangles {
+			a := o.Matrix.MulPosition(t.V1.Position)
+			e := ptEmitter{
+				a:      a,
+				e1:     o.Matrix.MulPosition(t.V2.Position).Sub(a),
+				e2:     o.Matrix.MulPosition(t.V3.Position).Sub(a),
+				object: len(s.objects) - 1,
+			}
+			area := e.e1.Cross(e.e2).Length() / 2
+			if area == 0 {
+				continue
+			}
+			s.power += area * l
+			s.emitters = append(s.emitters, e)
+			s.cdf = append(s.cdf, s.power)
+		}
+	}
+	s.eps = 1e-5 * (1 + extent)
+	return s
+}
+
+// intersect returns the nearest hit with T in (0, tMax] and the index of
+// the object hit, or -1.
+func (s *ptScene) intersect(r Ray, tMax float64) (Hit, int) {
+	inv := Vector{1 / r.Direction.X, 1 / r.Direction.Y, 1 / r.Direction.Z}
+	hit, index := Hit{T: tMax, Triangle: -1}, -1
+	for i := range s.objects {
+		o := &s.objects[i]
+		if _, ok := rayBox(r.Origin, inv, o.box, hit.T); !ok {
+			continue
+		}
+		local := Ray{o.inverse.MulPosition(r.Origin), o.inverse.mulVector(r.Direction)}
+		if h, ok := o.bvh.Intersect(local, hit.T); ok {
+			hit, index = h, i
+		}
+	}
+	return hit, index
+}
+
+func (s *ptScene) occluded(r Ray, tMax float64) bool {
+	inv := Vector{1 / r.Direction.X, 1 / r.Direction.Y, 1 / r.Direction.Z}
+	for i := range s.objects {
+		o := &s.objects[i]
+		if _, ok := rayBox(r.Origin, inv, o.box, tMax); !ok {
+			continue
+		}
+		local := Ray{o.inverse.MulPosition(r.Origin), o.inverse.mulVector(r.Direction)}
+		if o.bvh.Occluded(local, tMax) {
+			return true
+		}
+	}
+	return false
+}
+
+// trace follows a path from r and returns the light it carries back, and
+// whether r hit anything.
+func (s *ptScene) trace(r Ray, rnd *ptRand) (Color, bool) {
+	var radiance Color
+	throughput := Color{1, 1, 1, 1}
+	// pdf is the density the last bounce chose r with, 0 for camera rays.
+	pdf := 0.0
+	covered := false
+	for depth, skips := 0, 0; ; {
+		hit, index := s.intersect(r, math.Inf(1))
+		if index < 0 {
+			if covered {
+				radiance = radiance.Add(throughput.Mul(s.sky))
+			}
+			break
+		}
+		f := s.surface(r, hit, index)
+		if f.color.A < 1 && skips < 16 && rnd.float() >= f.color.A {
+			r.Origin = f.p.Sub(f.ng.MulScalar(s.eps))
+			skips++
+			continue
+		}
+		covered = true
+		wo := r.Direction.Negate()
+		if e := f.object.Emissive; luminance(e) > 0 {
+			w := 1.0
+			if pdf > 0 {
+				light := luminance(e) / s.power * hit.T * hit.T / f.ng.Dot(wo)
+				w = powerHeuristic(pdf, light)
+			}
+			radiance = radiance.Add(throughput.Mul(e).MulScalar(w))
+		}
+		if depth >= s.maxBounces {
+			break
+		}
+		radiance = radiance.Add(throughput.Mul(s.direct(&f, wo, rnd)))
+		wi := f.sample(wo, rnd)
+		c, p := f.eval(wo, wi)
+		if p <= 0 {
+			break
+		}
+		throughput = throughput.Mul(c.MulScalar(f.n.Dot(wi) / p))
+		pdf = p
+		depth++
+		if depth >= 3 {
+			q := math.Min(math.Max(throughput.R, math.Max(throughput.G, throughput.B)), 0.95)
+			if rnd.float() >= q {
+				break
+			}
+			throughput = throughput.DivScalar(q)
+		}
+		r = Ray{f.p.Add(f.ng.MulScalar(s.eps)), wi}
+	}
+	return radiance, covered
+}
+
+// direct samples the sun and one point on the emitters, returning the
+// light they reflect towards wo.
+func (s *ptScene) direct(f *ptSurface, wo Vector, rnd *ptRand) Color {
+	var c Color
+	origin := f.p.Add(f.ng.MulScalar(s.eps))
+	if luminance(s.sunColor) > 0 {
+		if brdf, p := f.eval(wo, s.sun); p > 0 && !s.occluded(Ray{origin, s.sun}, math.Inf(1)) {
+			c = c.Add(brdf.Mul(s.sunColor).MulScalar(math.Pi * f.n.Dot(s.sun)))
+		}
+	}
+	if len(s.emitters) == 0 {
+		return c
+	}
+	i := sort.SearchFloat64s(s.cdf, rnd.float()*s.power)
+	e := &s.emitters[minInt(i, len(s.emitters)-1)]
+	u, v := rnd.float(), rnd.float()
+	if u+v > 1 {
+		u, v = 1-u, 1-v
+	}
+	d := e.a.Add(e.e1.MulScalar(u)).Add(e.e2.MulScalar(v)).Sub(f.p)
+	dist := d.Length()
+	if dist <= 2*s.eps {
+		return c
+	}
+	wi := d.DivScalar(dist)
+	cos := math.Abs(e.e1.Cross(e.e2).Normalize().Dot(wi))
+	brdf, p := f.eval(wo, wi)
+	if cos <= 0 || p <= 0 || s.occluded(Ray{origin, wi}, dist-2*s.eps) {
+		return c
+	}
+	emitted := s.objects[e.object].object.Emissive
+	light := luminance(emitted) / s.power * dist * dist / cos
+	w := powerHeuristic(light, p)
+	return c.Add(brdf.Mul(emitted).MulScalar(f.n.Dot(wi) * w / light))
+}
+
+// ptSurface is the material of a hit point. n is the shading normal and ng
+// the geometric one, both turned towards the incoming ray.
+type ptSurface struct {
+	object   *Object
+	p, n, ng Vector
+	color    Color
+	specular float64
+	alpha    float64
+}
+
+func (s *ptScene) surface(r Ray, hit Hit, index int) ptSurface {
+	o := &s.objects[index]
+	t := o.object.Mesh.Triangles[hit.Triangle]
+	b := hit.Barycentric
+	v := InterpolateVertexes(t.V1, t.V2, t.V3, VectorW{b.X, b.Y, b.Z, 1})
+	ng := o.normal.MulDirection(t.Normal())
+	n := o.normal.MulDirection(v.Normal)
+	if ng.Dot(r.Direction) > 0 {
+		ng, n = ng.Negate(), n.Negate()
+	}
+	if n == (Vector{}) {
+		n = ng
+	}
+	roughness := Clamp(o.object.Roughness, 0, 1)
+	return ptSurface{
+		object:   o.object,
+		p:        r.Position(hit.T),
+		n:        n,
+		ng:       ng,
+		color:    objectColor(o.object, v, Vector{}, Vector{}, s.linear),
+		specular: Clamp(o.object.Specular, 0, 1),
+		alpha:    math.Max(roughness*roughness, 1e-3),
+	}
+}
+
+// glossyChance is the probability of sampling the glossy layer.
+func (f *ptSurface) glossyChance() float64 {
+	switch {
+	case f.specular <= 0:
+		return 0
+	case f.specular >= 1:
+		return 1
+	}
+	return 0.5
+}
+
+// eval returns the BRDF for light arriving from wi and leaving towards wo,
+// and the density with which sample picks wi. Both are 0 below the surface.
+func (f *ptSurface) eval(wo, wi Vector) (Color, float64) {
+	nl, nv := f.n.Dot(wi), f.n.Dot(wo)
+	if nl <= 0 || nv <= 0 || f.ng.Dot(wi) <= 0 {
+		return Color{}, 0
+	}
+	glossy := f.glossyChance()
+	c := f.color.MulScalar((1 - f.specular) / math.Pi)
+	pdf := (1 - glossy) * nl / math.Pi
+	if f.specular > 0 {
+		h := wo.Add(wi).Normalize()
+		nh, vh := math.Max(f.n.Dot(h), 0), math.Max(wo.Dot(h), 0)
+		d := ggxD(nh, f.alpha)
+		fresnel := f.specular + (1-f.specular)*math.Pow(1-vh, 5)
+		g := smithG1(nv, f.alpha) * smithG1(nl, f.alpha)
+		c = c.AddScalar(fresnel * d * g / (4 * nl * nv))
+		if vh > 0 {
+			pdf += glossy * d * nh / (4 * vh)
+		}
+	}
+	return c, pdf
+}
+
+// sample picks a direction for the next bounce from a cosine-weighted
+// hemisphere or from the GGX distribution of microfacet normals.
+func (f *ptSurface) sample(wo Vector, rnd *ptRand) Vector {
+	u1, u2 := rnd.float(), rnd.float()
+	if rnd.float() < f.glossyChance() {
+		t, b := basis(f.n)
+		phi := 2 * math.Pi * u1
+		a2 := f.alpha * f.alpha
+		cos := math.Sqrt((1 - u2) / (1 + (a2-1)*u2))
+		sin := math.Sqrt(math.Max(1-cos*cos, 0))
+		h := t.MulScalar(sin * math.Cos(phi)).Add(b.MulScalar(sin * math.Sin(phi))).Add(f.n.MulScalar(cos))
+		return h.MulScalar(2 * wo.Dot(h)).Sub(wo)
+	}
+	return cosineSample(f.n, u1, u2)
+}
+
+// cosineSample maps u1, u2 in [0, 1) to a direction in the hemisphere
+// around n, with density proportional to the cosine to n.
+func cosineSample(n Vector, u1, u2 float64) Vector {
+	t, b := basis(n)
+	phi := 2 * math.Pi * u1
+	r := math.Sqrt(u2)
+	return t.MulScalar(r * math.Cos(phi)).Add(b.MulScalar(r * math.Sin(phi))).Add(n.MulScalar(math.Sqrt(1 - u2)))
+}
+
+// basis returns two unit vectors that form an orthonormal basis with n
+// (Duff et al. 2017).
+func basis(n Vector) (Vector, Vector) {
+	sign := math.Copysign(1, n.Z)
+	a := -1 / (sign + n.Z)
+	b := n.X * n.Y * a
+	return Vector{1 + sign*n.X*n.X*a, sign * b, -sign * n.X}, Vector{b, sign + n.Y*n.Y*a, -n.Y}
+}
+
+func ggxD(nh, alpha float64) float64 {
+	a2 := alpha * alpha
+	d := nh*nh*(a2-1) + 1
+	return a2 / (math.Pi * d * d)
+}
+
+func smithG1(nv, alpha float64) float64 {
+	a2 := alpha * alpha
+	return 2 * nv / (nv + math.Sqrt(a2+(1-a2)*nv*nv))
+}
+
+func powerHeuristic(a, b float64) float64 {
+	a, b = a*a, b*b
+	return a / (a + b)
+}
+
+func luminance(c Color) float64 {
+	return 0.2126*c.R + 0.7152*c.G + 0.0722*c.B
+}
+
+// ptRand is a splitmix64 generator, cheap enough to seed per pixel and
+// sample.
+type ptRand uint64
+
+func newPTRand(seed int64, x, y, sample int) ptRand {
+	r := ptRand(seed)
+	r = ptRand(r.next() ^ uint64(x))
+	r = ptRand(r.next() ^ uint64(y))
+	return ptRand(r.next() ^ uint64(sample))
+}
+
+func (r *ptRand) next() uint64 {
+	*r += 0x9e3779b97f4a7c15
+	z := uint64(*r)
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+// float returns a number in [0, 1).
+func (r *ptRand) float() float64 {
+	return float64(r.next()>>11) / (1 << 53)
+}
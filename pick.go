@@ -0,0 +1,73 @@
+package aeno
+
+import "math"
+
+// PickResult describes the surface visible at a pixel.
+type PickResult struct {
+	Object *Object
+	// Triangle is the index in Object.Mesh.Triangles, or -1 when unknown.
+	Triangle int
+	// Barycentric holds the weights of the triangle's V1, V2 and V3 at the
+	// picked point.
+	Barycentric Vector
+	// Position is the picked point in world space.
+	Position Vector
+	Depth    float64
+}
+
+// Pick returns the object and triangle covering pixel (x, y) in the last
+// render. It reads the targets enabled with EnableTargets(TargetPick); the
+// triangle and barycentric coordinates are left empty when TriangleBuffer
+// or PositionBuffer is missing. ok is false when nothing was drawn there.
+func (dc *Context) Pick(x, y int) (result PickResult, ok bool) {
+	if x < 0 || y < 0 || x >= dc.Width || y >= dc.Height || dc.ObjectBuffer == nil {
+		return PickResult{Triangle: -1}, false
+	}
+	dc.Resolve()
+	i := y*dc.Width + x
+	result = PickResult{
+		Object:   dc.ObjectForID(dc.ObjectBuffer[i]),
+		Triangle: -1,
+		Depth:    dc.DepthBuffer[i],
+	}
+	if result.Object == nil {
+		return result, false
+	}
+	if dc.TriangleBuffer != nil {
+		result.Triangle = int(dc.TriangleBuffer[i])
+	}
+	if dc.PositionBuffer == nil {
+		return result, true
+	}
+	result.Position = dc.PositionBuffer[i]
+	mesh := result.Object.Mesh
+	if result.Triangle >= 0 && mesh != nil && result.Triangle < len(mesh.Triangles) {
+		t := mesh.Triangles[result.Triangle]
+		m := result.Object.Matrix
+		result.Barycentric = barycentric(result.Position,
+			m.MulPosition(t.V1.Position),
+			m.MulPosition(t.V2.Position),
+			m.MulPosition(t.V3.Position))
+	}
+	return result, true
+}
+
+// barycentric returns the weights of a, b and c for the projection of p
+// onto their plane.
+func barycentric(p, a, b, c Vector) Vector {
+	v0 := b.Sub(a)
+	v1 := c.Sub(a)
+	v2 := p.Sub(a)
+	d00 := v0.Dot(v0)
+	d01 := v0.Dot(v1)
+	d11 := v1.Dot(v1)
+	d20 := v2.Dot(v0)
+	d21 := v2.Dot(v1)
+	d := d00*d11 - d01*d01
+	if math.Abs(d) < 1e-18 {
+		return Vector{1, 0, 0}
+	}
+	v := (d11*d20 - d01*d21) / d
+	w := (d00*d21 - d01*d20) / d
+	return Vector{1 - v - w, v, w}
+}
@@ -0,0 +1,300 @@
+package aeno
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// PostProcess is a full-screen pass run on a Context after drawing. Passes
+// read and write ColorBuffer and may use DepthBuffer and the other buffers
+// of the Context.
+type PostProcess interface {
+	Apply(dc *Context)
+}
+
+// PostProcessFunc adapts an ordinary function to the PostProcess interface.
+type PostProcessFunc func(dc *Context)
+
+// Apply calls f(dc).
+func (f PostProcessFunc) Apply(dc *Context) {
+	f(dc)
+}
+
+// ApplyPostProcess resolves the Context and runs its PostProcess chain in
+// order. Scene.Render calls it after drawing all objects.
+func (dc *Context) ApplyPostProcess() {
+	dc.Resolve()
+	for _, p := range dc.PostProcess {
+		p.Apply(dc)
+	}
+}
+
+// floatImage returns ColorBuffer as premultiplied floats.
+func (dc *Context) floatImage() *floatImage {
+	return newFloatImage(dc.ColorBuffer)
+}
+
+// setFloatImage writes a premultiplied float image back to ColorBuffer.
+func (dc *Context) setFloatImage(f *floatImage) {
+	parallel(f.h, func(y int) {
+		for x := 0; x < f.w; x++ {
+			c := f.at(x, y).unpremultiply()
+			i := dc.ColorBuffer.PixOffset(x, y)
+			nrgba := c.NRGBA()
+			dc.ColorBuffer.Pix[i+0] = nrgba.R
+			dc.ColorBuffer.Pix[i+1] = nrgba.G
+			dc.ColorBuffer.Pix[i+2] = nrgba.B
+			dc.ColorBuffer.Pix[i+3] = nrgba.A
+		}
+	})
+}
+
+// gaussianBlur blurs a premultiplied float image with a separable gaussian
+// kernel of the given radius in pixels.
+func gaussianBlur(f *floatImage, radius int) *floatImage {
+	if radius < 1 {
+		return f
+	}
+	sigma := math.Max(float64(radius)/2, 0.5)
+	kernel := make([]float64, radius*2+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	pass := func(src *floatImage, dx, dy int) *floatImage {
+		dst := &floatImage{src.w, src.h, make([]float64, len(src.pix))}
+		parallel(src.h, func(y int) {
+			for x := 0; x < src.w; x++ {
+				var c [4]float64
+				for k, weight := range kernel {
+					sx := ClampInt(x+(k-radius)*dx, 0, src.w-1)
+					sy := ClampInt(y+(k-radius)*dy, 0, src.h-1)
+					p := src.pix[(sy*src.w+sx)*4:]
+					c[0] += p[0] * weight
+					c[1] += p[1] * weight
+					c[2] += p[2] * weight
+					c[3] += p[3] * weight
+				}
+				copy(dst.pix[(y*src.w+x)*4:], c[:])
+			}
+		})
+		return dst
+	}
+	return pass(pass(f, 1, 0), 0, 1)
+}
+
+// FXAAPass runs FXAA as part of a PostProcess chain.
+type FXAAPass struct{}
+
+// Apply f
+func (FXAAPass) Apply(dc *Context) {
+	dc.FXAA()
+}
+
+// Blur is a gaussian blur of Radius pixels.
+type Blur struct {
+	Radius int
+}
+
+// Apply f
+func (p Blur) Apply(dc *Context) {
+	dc.setFloatImage(gaussianBlur(dc.floatImage(), p.Radius))
+}
+
+// Sharpen is an unsharp mask: the difference between the image and a blur
+// of Radius pixels is scaled by Amount and added back.
+type Sharpen struct {
+	Amount float64
+	Radius int
+}
+
+// Apply f
+func (p Sharpen) Apply(dc *Context) {
+	f := dc.floatImage()
+	blurred := gaussianBlur(f, maxInt(p.Radius, 1))
+	for i := range f.pix {
+		if i%4 == 3 {
+			continue
+		}
+		a := f.pix[i-i%4+3]
+		f.pix[i] = Clamp(f.pix[i]+(f.pix[i]-blurred.pix[i])*p.Amount, 0, a)
+	}
+	dc.setFloatImage(f)
+}
+
+// Bloom adds a blurred copy of the pixels brighter than Threshold (by luma)
+// back onto the image, scaled by Intensity.
+type Bloom struct {
+	Threshold float64
+	Intensity float64
+	Radius    int
+}
+
+// Apply f
+func (p Bloom) Apply(dc *Context) {
+	f := dc.floatImage()
+	bright := &floatImage{f.w, f.h, make([]float64, len(f.pix))}
+	for i := 0; i < len(f.pix); i += 4 {
+		c := f.pix[i : i+4]
+		luma := 0.2126*c[0] + 0.7152*c[1] + 0.0722*c[2]
+		if luma > p.Threshold && luma > 0 {
+			k := (luma - p.Threshold) / luma
+			bright.pix[i+0] = c[0] * k
+			bright.pix[i+1] = c[1] * k
+			bright.pix[i+2] = c[2] * k
+			bright.pix[i+3] = c[3] * k
+		}
+	}
+	bright = gaussianBlur(bright, p.Radius)
+	for i := range f.pix {
+		f.pix[i] = math.Min(f.pix[i]+bright.pix[i]*p.Intensity, 1)
+	}
+	// Keep color premultiplied by the (possibly increased) alpha.
+	for i := 0; i < len(f.pix); i += 4 {
+		a := f.pix[i+3]
+		f.pix[i+0] = math.Min(f.pix[i+0], a)
+		f.pix[i+1] = math.Min(f.pix[i+1], a)
+		f.pix[i+2] = math.Min(f.pix[i+2], a)
+	}
+	dc.setFloatImage(f)
+}
+
+// Vignette darkens the image towards its corners. Radius is the distance
+// from the center, relative to the half diagonal, where darkening starts,
+// Softness the width of the falloff and Strength how dark the corners get.
+type Vignette struct {
+	Strength float64
+	Radius   float64
+	Softness float64
+}
+
+// Apply f
+func (p Vignette) Apply(dc *Context) {
+	cx, cy := float64(dc.Width)/2, float64(dc.Height)/2
+	diag := math.Hypot(cx, cy)
+	parallel(dc.Height, func(y int) {
+		for x := 0; x < dc.Width; x++ {
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / diag
+			t := Clamp((d-p.Radius)/math.Max(p.Softness, 1e-6), 0, 1)
+			k := 1 - p.Strength*t*t*(3-2*t)
+			i := dc.ColorBuffer.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				dc.ColorBuffer.Pix[i+c] = uint8(float64(dc.ColorBuffer.Pix[i+c])*k + 0.5)
+			}
+		}
+	})
+}
+
+// ColorGrade maps every pixel through a 3D color lookup table.
+type ColorGrade struct {
+	LUT *ColorLUT
+}
+
+// Apply f
+func (p ColorGrade) Apply(dc *Context) {
+	parallel(dc.Height, func(y int) {
+		for x := 0; x < dc.Width; x++ {
+			i := dc.ColorBuffer.PixOffset(x, y)
+			px := dc.ColorBuffer.Pix[i : i+4]
+			c := Color{float64(px[0]) / 255, float64(px[1]) / 255, float64(px[2]) / 255, float64(px[3]) / 255}
+			nrgba := p.LUT.Lookup(c).Alpha(c.A).NRGBA()
+			px[0], px[1], px[2] = nrgba.R, nrgba.G, nrgba.B
+		}
+	})
+}
+
+// ColorLUT is a 3D color lookup table of Size^3 entries, indexed with red
+// varying fastest, then green, then blue.
+type ColorLUT struct {
+	Size int
+	Data []Color
+}
+
+// NewColorLUT builds a LUT of the given size by evaluating f at each grid
+// point.
+func NewColorLUT(size int, f func(Color) Color) *ColorLUT {
+	lut := &ColorLUT{size, make([]Color, size*size*size)}
+	d := float64(size - 1)
+	for b := 0; b < size; b++ {
+		for g := 0; g < size; g++ {
+			for r := 0; r < size; r++ {
+				c := Color{float64(r) / d, float64(g) / d, float64(b) / d, 1}
+				lut.Data[(b*size+g)*size+r] = f(c)
+			}
+		}
+	}
+	return lut
+}
+
+// LoadCubeLUT loads a LUT in the Adobe/Resolve .cube format.
+func LoadCubeLUT(path string) (*ColorLUT, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadCubeLUTFromReader(file)
+}
+
+func LoadCubeLUTFromReader(r io.Reader) (*ColorLUT, error) {
+	lut := &ColorLUT{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "LUT_3D_SIZE":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("invalid LUT_3D_SIZE line")
+			}
+			lut.Size = int(ParseFloats(fields[1:2])[0])
+		case "TITLE", "DOMAIN_MIN", "DOMAIN_MAX", "LUT_1D_SIZE":
+			continue
+		default:
+			if len(fields) < 3 {
+				continue
+			}
+			f := ParseFloats(fields[:3])
+			lut.Data = append(lut.Data, Color{f[0], f[1], f[2], 1})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lut.Size < 2 || len(lut.Data) != lut.Size*lut.Size*lut.Size {
+		return nil, fmt.Errorf("cube LUT has %d entries for size %d", len(lut.Data), lut.Size)
+	}
+	return lut, nil
+}
+
+// Lookup maps a color through the LUT with trilinear interpolation.
+func (lut *ColorLUT) Lookup(c Color) Color {
+	n := lut.Size
+	d := float64(n - 1)
+	fr := Clamp(c.R, 0, 1) * d
+	fg := Clamp(c.G, 0, 1) * d
+	fb := Clamp(c.B, 0, 1) * d
+	r0, g0, b0 := int(fr), int(fg), int(fb)
+	r1, g1, b1 := minInt(r0+1, n-1), minInt(g0+1, n-1), minInt(b0+1, n-1)
+	tr, tg, tb := fr-float64(r0), fg-float64(g0), fb-float64(b0)
+	at := func(r, g, b int) Color {
+		return lut.Data[(b*n+g)*n+r]
+	}
+	c00 := at(r0, g0, b0).Lerp(at(r1, g0, b0), tr)
+	c10 := at(r0, g1, b0).Lerp(at(r1, g1, b0), tr)
+	c01 := at(r0, g0, b1).Lerp(at(r1, g0, b1), tr)
+	c11 := at(r0, g1, b1).Lerp(at(r1, g1, b1), tr)
+	return c00.Lerp(c10, tg).Lerp(c01.Lerp(c11, tg), tb)
+}
@@ -0,0 +1,125 @@
+package aeno
+
+import "math"
+
+// Ray is a half line starting at Origin.
+type Ray struct {
+	Origin, Direction Vector
+}
+
+// Position returns the point at distance t along the ray, in units of
+// Direction.
+func (r Ray) Position(t float64) Vector {
+	return r.Origin.Add(r.Direction.MulScalar(t))
+}
+
+// Hit describes where a ray meets a triangle.
+type Hit struct {
+	// T is the ray parameter of the hit, so the hit point is
+	// Ray.Position(T). It is the distance when Direction has unit length.
+	T float64
+	// Triangle is the index of the triangle in the mesh.
+	Triangle int
+	// Barycentric holds the weights of the triangle's V1, V2 and V3.
+	Barycentric Vector
+	// Object is the object that was hit, nil for mesh and BVH queries.
+	Object *Object
+	// Vertex is interpolated from the triangle corners. Object hits have
+	// Position and Normal in world space. BVH queries leave it empty.
+	Vertex Vertex
+}
+
+// Intersect returns the nearest hit of the ray with the mesh triangles,
+// with T in (0, tMax].
+func (m *Mesh) Intersect(r Ray, tMax float64) (Hit, bool) {
+	hit, ok := m.BVH().Intersect(r, tMax)
+	if !ok {
+		return hit, false
+	}
+	t := m.Triangles[hit.Triangle]
+	b := hit.Barycentric
+	hit.Vertex = InterpolateVertexes(t.V1, t.V2, t.V3, VectorW{b.X, b.Y, b.Z, 1})
+	hit.Vertex.Output = VectorW{}
+	if hit.Vertex.Normal == (Vector{}) {
+		hit.Vertex.Normal = t.Normal()
+	}
+	return hit, true
+}
+
+// Intersect returns the nearest hit of a world-space ray with the object,
+// with T in (0, tMax].
+func (o *Object) Intersect(r Ray, tMax float64) (Hit, bool) {
+	if o.Mesh == nil {
+		return Hit{T: tMax, Triangle: -1}, false
+	}
+	inv := o.Matrix.Inverse()
+	local := Ray{inv.MulPosition(r.Origin), inv.mulVector(r.Direction)}
+	hit, ok := o.Mesh.Intersect(local, tMax)
+	if !ok {
+		return hit, false
+	}
+	hit.Object = o
+	hit.Vertex.Position = o.Matrix.MulPosition(hit.Vertex.Position)
+	hit.Vertex.Normal = inv.Transpose().MulDirection(hit.Vertex.Normal)
+	return hit, true
+}
+
+// Intersect returns the nearest hit of a world-space ray with the scene
+// objects.
+func (s *Scene) Intersect(r Ray) (Hit, bool) {
+	inv := Vector{1 / r.Direction.X, 1 / r.Direction.Y, 1 / r.Direction.Z}
+	best := Hit{T: math.Inf(1), Triangle: -1}
+	found := false
+	for _, o := range s.Objects {
+		if o.Mesh == nil {
+			continue
+		}
+		box := o.Matrix.MulBox(o.Mesh.BoundingBox())
+		if _, ok := rayBox(r.Origin, inv, box, best.T); !ok {
+			continue
+		}
+		if hit, ok := o.Intersect(r, best.T); ok {
+			best, found = hit, true
+		}
+	}
+	return best, found
+}
+
+// mulVector applies the linear part of the matrix without normalizing, so
+// ray parameters are kept across spaces.
+func (a Matrix) mulVector(b Vector) Vector {
+	x := a.X00*b.X + a.X01*b.Y + a.X02*b.Z
+	y := a.X10*b.X + a.X11*b.Y + a.X12*b.Z
+	z := a.X20*b.X + a.X21*b.Y + a.X22*b.Z
+	return Vector{x, y, z}
+}
+
+// PixelRay returns the world-space ray through the point (x, y) of a
+// width by height image drawn with the view-projection matrix. Pixel
+// centers lie at half-integer coordinates. The ray starts on the near plane
+// and its Direction has unit length, for perspective and orthographic
+// projections alike.
+func PixelRay(matrix Matrix, width, height int, x, y float64) Ray {
+	return unproject(Screen(width, height).Mul(matrix).Inverse(), x, y)
+}
+
+// PixelRay returns the world-space ray through the center of pixel (x, y)
+// for the Context shader and Viewport. ok is false when the shader has no
+// view-projection matrix.
+func (dc *Context) PixelRay(x, y int) (Ray, bool) {
+	vs, ok := dc.Shader.(viewShader)
+	if !ok {
+		return Ray{}, false
+	}
+	inv := dc.viewportMatrix().Mul(vs.viewProjection()).Inverse()
+	return unproject(inv, float64(x)+0.5, float64(y)+0.5), true
+}
+
+// unproject maps screen point (x, y) at depth 0 and 1 back through inv.
+func unproject(inv Matrix, x, y float64) Ray {
+	n := inv.MulPositionW(Vector{x, y, 0})
+	f := inv.MulPositionW(Vector{x, y, 1})
+	near := n.Vector().DivScalar(n.W)
+	far := f.Vector().DivScalar(f.W)
+	return Ray{near, far.Sub(near).Normalize()}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"log"
+	"sort"
 )
 
 type Scene struct {
@@ -14,13 +15,31 @@ type Scene struct {
 	Eye     Vector
 	Center  Vector
 	Up      Vector
+	// Camera, when set, takes the place of Eye, Center and Up: Render
+	// points the Context shader through it, and FitObjectsToScene widens
+	// it using its own projection.
+	Camera *Camera
+	// FrustumCulling skips objects whose transformed bounding box lies
+	// outside the view of the Context shader. It needs a shader with a
+	// view-projection matrix, such as PhongShader or ToonShader.
+	FrustumCulling bool
+	// Stats describes the last Render.
+	Stats RenderStats
+}
+
+// RenderStats counts the objects handled by Scene.Render.
+type RenderStats struct {
+	Objects int
+	Drawn   int
+	Culled  int
 }
 
 func NewScene(width, height int, shader Shader) *Scene {
 	return &Scene{
-		Context: NewContext(width, height, shader),
-		Objects: []*Object{},
-		Up:      Vector{0, 0, 1}, // Default Up
+		Context:        NewContext(width, height, shader),
+		Objects:        []*Object{},
+		Up:             Vector{0, 0, 1}, // Default Up
+		FrustumCulling: true,
 	}
 }
 
@@ -28,15 +47,22 @@ func (s *Scene) Add(o *Object) {
 	s.Objects = append(s.Objects, o)
 }
 
-// FitObjectsToScene automatically positions the eye to see all objects.
+// FitObjectsToScene scales all objects into a bi-unit cube and widens the
+// view until they are all inside it. Without a Camera, a perspective view
+// from Eye with the given parameters is widened and set on the Context
+// PhongShader. With a Camera, the arguments are ignored and the Camera
+// itself is widened, keeping its projection.
 func (s *Scene) FitObjectsToScene(fovy, aspect, near, far float64) {
 	if len(s.Objects) == 0 {
 		return
 	}
 	
-	viewMatrix := LookAt(s.Eye, s.Center, s.Up)
-	matrix := viewMatrix.Perspective(fovy, aspect, near, far)
-	shader := NewPhongShader(matrix, Vector{}, s.Eye, HexColor("000000"), HexColor("000000"))
+	camera := NewPerspectiveCamera(s.Eye, s.Center, s.Up, fovy, aspect, near, far)
+	if s.Camera != nil {
+		camera = s.Camera
+	}
+	fit := *camera
+	shader := NewPhongShader(fit.Matrix(), Vector{}, fit.Eye, HexColor("000000"), HexColor("000000"))
 
 	allMesh := NewEmptyMesh()
 	var boxes []Box
@@ -61,7 +87,6 @@ func (s *Scene) FitObjectsToScene(fovy, aspect, near, far float64) {
 	allMesh.FitInside(unitCube.BoundingBox(), V(0.5, 0.5, 0.5))
 
 	indexed := 0
-	var addedFOV float64
 	for _, o := range s.Objects {
 		if o.Mesh == nil { continue }
 		
@@ -77,9 +102,8 @@ func (s *Scene) FitObjectsToScene(fovy, aspect, near, far float64) {
 				v3 := shader.Vertex(t.V3)
 
 				if v1.Outside() || v2.Outside() || v3.Outside() {
-					addedFOV += 5
-					matrix = viewMatrix.Perspective(fovy+addedFOV, aspect, near, far)
-					shader.Matrix = matrix
+					fit.widen(5)
+					shader.Matrix = fit.Matrix()
 					allInside = false
 				} else {
 					allInside = true
@@ -92,8 +116,11 @@ func (s *Scene) FitObjectsToScene(fovy, aspect, near, far float64) {
 		indexed += num
 	}
 	
-	if phong, ok := s.Context.Shader.(*PhongShader); ok {
-		phong.Matrix = viewMatrix.Perspective(fovy+addedFOV+2.0, aspect, near, far)
+	fit.widen(2)
+	if s.Camera != nil {
+		*s.Camera = fit
+	} else if phong, ok := s.Context.Shader.(*PhongShader); ok {
+		phong.Matrix = fit.Matrix()
 	}
 }
 
@@ -106,7 +133,11 @@ func (s *Scene) GetSafetyClipping() (near, far float64) {
 		box = box.Extend(s.Objects[i].Mesh.BoundingBox().Transform(s.Objects[i].Matrix))
 	}
 
-	distToCenter := s.Eye.Sub(box.Center()).Length()
+	eye := s.Eye
+	if s.Camera != nil {
+		eye = s.Camera.Eye
+	}
+	distToCenter := eye.Sub(box.Center()).Length()
 	
 	// The radius of the object (from center to furthest corner)
 	radius := box.Size().Length() / 2.0
@@ -124,10 +155,75 @@ func (s *Scene) GetSafetyClipping() (near, far float64) {
 	return near, far
 }
 
+// Render draws all objects and then runs the Context PostProcess chain.
+// Opaque objects are drawn first, in order. Transparent objects follow,
+// sorted back to front by the view depth of their bounding box centers,
+// with depth writes disabled. Objects outside the view are skipped when
+// FrustumCulling is set.
 func (s *Scene) Render() {
+	s.applyCamera()
+	s.Stats = RenderStats{Objects: len(s.Objects)}
+	frustum, cull := s.frustum()
+	var transparent []*Object
 	for _, o := range s.Objects {
+		if cull && !frustum.IntersectsBox(o.Matrix.MulBox(o.Mesh.BoundingBox())) {
+			s.Stats.Culled++
+			continue
+		}
+		s.Stats.Drawn++
+		if o.Transparent() {
+			transparent = append(transparent, o)
+			continue
+		}
 		s.Context.DrawObject(o)
 	}
+	if len(transparent) > 0 {
+		s.sortBackToFront(transparent)
+		writeDepth := s.Context.WriteDepth
+		s.Context.WriteDepth = false
+		for _, o := range transparent {
+			s.Context.DrawObject(o)
+		}
+		s.Context.WriteDepth = writeDepth
+	}
+	s.Context.ApplyPostProcess()
+}
+
+// applyCamera points the Context shader through Camera, when both are set.
+func (s *Scene) applyCamera() {
+	if s.Camera == nil {
+		return
+	}
+	if cs, ok := s.Context.Shader.(cameraShader); ok {
+		cs.setCamera(s.Camera)
+	}
+}
+
+// frustum returns the view frustum of the Context shader, and false when
+// culling is off or the shader has no view-projection matrix.
+func (s *Scene) frustum() (ViewFrustum, bool) {
+	if !s.FrustumCulling {
+		return ViewFrustum{}, false
+	}
+	vs, ok := s.Context.Shader.(viewShader)
+	if !ok {
+		return ViewFrustum{}, false
+	}
+	return NewViewFrustum(vs.viewProjection()), true
+}
+
+// sortBackToFront orders objects by the depth their bounding box center
+// gets from the Context shader, farthest first.
+func (s *Scene) sortBackToFront(objects []*Object) {
+	depth := make(map[*Object]float64, len(objects))
+	for _, o := range objects {
+		center := o.Matrix.MulBox(o.Mesh.BoundingBox()).Center()
+		out := s.Context.Shader.Vertex(Vertex{Position: center}).Output
+		depth[o] = out.Z / out.W
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return depth[objects[i]] > depth[objects[j]]
+	})
 }
 
 func (s *Scene) Save(path string) error {
@@ -156,24 +252,32 @@ func GenerateScene(fit bool, path string, objects []*Object, eye Vector, center
 }
 
 func GenerateSceneToWriter(writer io.Writer, objects []*Object, eye Vector, center Vector, up Vector, fovy float64, size int, scale int, light Vector, ambient string, diffuse string, near, far float64, fit bool) error {
-	renderSize := size * scale
     aspect := float64(size) / float64(size)
+	camera := NewPerspectiveCamera(eye, center, up, fovy, aspect, near, far)
+	return GenerateSceneToWriterWithCamera(writer, objects, camera, size, scale, light, ambient, diffuse, fit)
+}
+
+// GenerateSceneToWriterWithCamera renders the objects as seen by camera
+// into a size by size PNG, drawing at scale times the size and
+// downsampling. The camera is copied, so fitting does not change it.
+func GenerateSceneToWriterWithCamera(writer io.Writer, objects []*Object, camera *Camera, size int, scale int, light Vector, ambient string, diffuse string, fit bool) error {
+	renderSize := size * scale
+	view := *camera
 
-	// Initial matrix setup
-	matrix := LookAt(eye, center, up).Perspective(fovy, aspect, near, far)
-	shader := NewPhongShader(matrix, light, eye, HexColor(ambient), HexColor(diffuse))
+	shader := NewPhongShader(view.Matrix(), light, view.Eye, HexColor(ambient), HexColor(diffuse))
 	
 	scene := NewScene(renderSize, renderSize, shader)
 	scene.Objects = objects
-	scene.Eye = eye
-	scene.Center = center
-	scene.Up = up
+	scene.Camera = &view
+	scene.Eye = view.Eye
+	scene.Center = view.Center
+	scene.Up = view.Up
 
 	scene.Context.ClearColorBufferWith(Transparent)
 	scene.Context.ClearDepthBuffer()
 
 	if fit {
-		scene.FitObjectsToScene(fovy, aspect, near, far)
+		scene.FitObjectsToScene(view.Fovy, view.Aspect, view.Near, view.Far)
 	}
 
 	scene.Render()
@@ -10,6 +10,28 @@ type Shader interface {
 	Fragment(Vertex, *Object) Color
 }
 
+// GradientShader is implemented by shaders that want the screen-space
+// derivatives of the texture coordinate, e.g. for mipmapped sampling. The
+// rasterizer calls FragmentGrad instead of Fragment for such shaders, with
+// dx and dy being the change in Vertex.Texture across one pixel.
+type GradientShader interface {
+	Shader
+	FragmentGrad(v Vertex, dx, dy Vector, fromObject *Object) Color
+}
+
+// contextShader is implemented by the built-in shaders so that they can
+// adapt to the Context settings, such as ColorSpace, before each draw.
+type contextShader interface {
+	configure(dc *Context)
+}
+
+// viewShader is implemented by shaders that transform world space
+// positions by a view-projection matrix, which DrawObject combines with the
+// object matrix.
+type viewShader interface {
+	viewProjection() Matrix
+}
+
 // PhongShader implements Phong shading with an optional texture.
 type PhongShader struct {
 	Matrix         Matrix
@@ -22,6 +44,8 @@ type PhongShader struct {
 	EnableOutline  bool    // A switch to turn the effect on/off
 	OutlineColor   Color   // The color of the outline
 	OutlineFactor  float64 // Controls line thickness (lower is thicker)
+	linear         bool
+	hdr            bool
 }
 
 // NewPhongShader f
@@ -41,6 +65,28 @@ func NewPhongShader(matrix Matrix, lightDirection, cameraPosition Vector, ambien
 	}
 }
 
+func (shader *PhongShader) configure(dc *Context) {
+	shader.linear = dc.ColorSpace == ColorSpaceSRGB
+	shader.hdr = dc.HDRBuffer != nil
+}
+
+func (shader *PhongShader) viewProjection() Matrix {
+	return shader.Matrix
+}
+
+func (shader *PhongShader) setCamera(c *Camera) {
+	shader.Matrix = c.Matrix()
+	shader.CameraPosition = c.Eye
+}
+
+// withMatrix returns a copy of the shader that also applies m to vertex
+// positions.
+func (shader *PhongShader) withMatrix(m Matrix) Shader {
+	c := *shader
+	c.Matrix = shader.Matrix.Mul(m)
+	return &c
+}
+
 // Vertex f
 func (shader *PhongShader) Vertex(v Vertex) Vertex {
 	v.Output = shader.Matrix.MulPositionW(v.Position)
@@ -49,31 +95,22 @@ func (shader *PhongShader) Vertex(v Vertex) Vertex {
 
 // Fragment f
 func (shader *PhongShader) Fragment(v Vertex, fromObject *Object) Color {
+	return shader.FragmentGrad(v, Vector{}, Vector{}, fromObject)
+}
+
+// FragmentGrad f
+func (shader *PhongShader) FragmentGrad(v Vertex, dx, dy Vector, fromObject *Object) Color {
 	if shader.EnableOutline {
 		viewDirection := shader.CameraPosition.Sub(v.Position).Normalize()
 		dot := viewDirection.Dot(v.Normal)
 
 		// If the surface normal is nearly perpendicular to the view direction, it's an edge.
 		if math.Abs(dot) < shader.OutlineFactor {
-			return shader.OutlineColor
+			return decodeColor(shader.OutlineColor, shader.linear)
 		}
 	}
-	// If the object is flagged to use vertex colors, we return the
-	// interpolated vertex color and skip all lighting and texturing.
-	color := fromObject.Color
-    if fromObject.UseVertexColor {
-        color = color.Mul(v.Color)
-    }
-	
+	color := objectColor(fromObject, v, dx, dy, shader.linear)
 	light := shader.AmbientColor
-	if fromObject.Texture != nil {
-        sample := fromObject.Texture.BilinearSample(v.Texture.X, v.Texture.Y)
-        if fromObject.UseVertexColor {
-            color = color.Mul(sample)
-        } else if sample.A > 0 {
-            color = color.Lerp(sample.DivScalar(sample.A), sample.A)
-        }
-    }
 	diffuse := math.Max(v.Normal.Dot(shader.LightDirection), 0)
 	light = light.Add(shader.DiffuseColor.MulScalar(diffuse))
 	if diffuse > 0 && shader.SpecularPower > 0 {
@@ -86,7 +123,10 @@ func (shader *PhongShader) Fragment(v Vertex, fromObject *Object) Color {
 		}
 	}
 	
-	final := color.Mul(light).Min(White)
+	final := color.Mul(light).Add(fromObject.Emissive.Alpha(0))
+	if !shader.hdr {
+		final = final.Min(White)
+	}
     if color.A > 0.0001 && color.A < 1.0 {
         return final.DivScalar(color.A).Alpha(color.A)
     } else if color.A <= 0.0001 {
@@ -95,3 +135,42 @@ func (shader *PhongShader) Fragment(v Vertex, fromObject *Object) Color {
 
     return final.Alpha(color.A)
 }
+
+// decodeColor converts a surface color to the space shading happens in,
+// linear light when linear is set. Light colors are intensities and are
+// always used as given.
+func decodeColor(c Color, linear bool) Color {
+	if linear {
+		return c.Linear()
+	}
+	return c
+}
+
+// objectColor returns the surface color of an object at v: its Color,
+// multiplied by the vertex color when UseVertexColor is set, combined with
+// its texture. linear decodes sRGB inputs to linear light.
+func objectColor(o *Object, v Vertex, dx, dy Vector, linear bool) Color {
+	color := decodeColor(o.Color, linear)
+	if o.UseVertexColor {
+		color = color.Mul(decodeColor(v.Color, linear))
+	}
+	if o.Texture == nil {
+		return color
+	}
+	var sample Color
+	if t, ok := o.Texture.(gradientTexture); ok {
+		sample = t.SampleGrad(v.Texture.X, v.Texture.Y, dx, dy)
+	} else {
+		sample = o.Texture.BilinearSample(v.Texture.X, v.Texture.Y)
+	}
+	if linear {
+		sample = sample.linearPremultiplied()
+	}
+	if o.UseVertexColor {
+		return color.Mul(sample)
+	}
+	if sample.A > 0 {
+		color = color.Lerp(sample.DivScalar(sample.A), sample.A)
+	}
+	return color
+}
@@ -0,0 +1,160 @@
+package aeno
+
+import "math"
+
+// SSAO is a post pass that approximates ambient occlusion from the depth
+// buffer, darkening creases and the areas where surfaces nearly touch.
+// When the Context has a NormalBuffer it is used to keep the local surface
+// estimate from bleeding across creases.
+type SSAO struct {
+	// Radius is the sampling radius in pixels.
+	Radius float64
+	// Intensity scales how dark fully occluded pixels get, from 0 to 1.
+	Intensity float64
+	// Distance is the largest depth difference, relative to the distance
+	// from the camera, at which a sample still occludes. Farther samples
+	// fade out so background objects do not darken foreground edges.
+	Distance float64
+	// Bias is the smallest relative depth difference that occludes.
+	Bias float64
+	// Samples is the number of depth samples taken per pixel.
+	Samples int
+}
+
+// NewSSAO returns an SSAO pass with defaults suited to most scenes.
+func NewSSAO(radius, intensity float64) SSAO {
+	return SSAO{
+		Radius:    radius,
+		Intensity: intensity,
+		Distance:  0.05,
+		Bias:      0.0005,
+		Samples:   16,
+	}
+}
+
+// ssaoDither rotates the sample kernel per pixel in a 4x4 pattern that the
+// blur pass averages back out.
+var ssaoDither = [16]float64{0, 8, 2, 10, 12, 4, 14, 6, 3, 11, 1, 9, 15, 7, 13, 5}
+
+// Apply f
+func (p SSAO) Apply(dc *Context) {
+	dc.Resolve()
+	w, h := dc.Width, dc.Height
+	depth := dc.DepthBuffer
+	n := maxInt(p.Samples, 1)
+
+	// Spiral kernel that covers the disk evenly.
+	kernel := make([]Vector, n)
+	golden := math.Pi * (3 - math.Sqrt(5))
+	for k := range kernel {
+		r := p.Radius * math.Sqrt((float64(k)+0.5)/float64(n))
+		a := float64(k) * golden
+		kernel[k] = Vector{r * math.Cos(a), r * math.Sin(a), 0}
+	}
+
+	occlusion := make([]float64, w*h)
+	parallel(h, func(y int) {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			dC := depth[i]
+			if dC == math.MaxFloat64 {
+				continue
+			}
+			gx, gy := dc.ssaoGradient(x, y)
+			scale := 1 / math.Max(1-dC, 1e-9)
+			a := ssaoDither[(y&3)*4+(x&3)] / 16 * 2 * math.Pi
+			sin, cos := math.Sin(a), math.Cos(a)
+			var sum float64
+			for _, k := range kernel {
+				ox := k.X*cos - k.Y*sin
+				oy := k.X*sin + k.Y*cos
+				sx, sy := x+int(math.Round(ox)), y+int(math.Round(oy))
+				if sx < 0 || sy < 0 || sx >= w || sy >= h {
+					continue
+				}
+				d := depth[sy*w+sx]
+				if d == math.MaxFloat64 {
+					continue
+				}
+				// How far the sample sits in front of the tangent plane.
+				diff := (dC + gx*float64(sx-x) + gy*float64(sy-y) - d) * scale
+				if diff <= p.Bias {
+					continue
+				}
+				if diff > p.Distance {
+					sum += p.Distance / diff
+				} else {
+					sum++
+				}
+			}
+			occlusion[i] = sum / float64(n)
+		}
+	})
+
+	parallel(h, func(y int) {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			dC := depth[i]
+			if dC == math.MaxFloat64 {
+				continue
+			}
+			// Average the 4x4 dither block, skipping pixels on other
+			// surfaces so the occlusion stays sharp at silhouettes.
+			limit := p.Distance * (1 - dC)
+			var sum, count float64
+			for by := y - 1; by <= y+2; by++ {
+				for bx := x - 1; bx <= x+2; bx++ {
+					if bx < 0 || by < 0 || bx >= w || by >= h {
+						continue
+					}
+					j := by*w + bx
+					if math.Abs(depth[j]-dC) > limit {
+						continue
+					}
+					sum += occlusion[j]
+					count++
+				}
+			}
+			k := 1 - Clamp(p.Intensity*sum/count, 0, 1)
+			o := dc.ColorBuffer.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				dc.ColorBuffer.Pix[o+c] = uint8(float64(dc.ColorBuffer.Pix[o+c])*k + 0.5)
+			}
+		}
+	})
+}
+
+// ssaoGradient estimates the screen-space depth slope at (x, y). Of the two
+// one-sided differences along each axis it uses the one on the same surface:
+// the one whose normal matches when normals are available, otherwise the
+// smaller one.
+func (dc *Context) ssaoGradient(x, y int) (float64, float64) {
+	w, h := dc.Width, dc.Height
+	i := y*w + x
+	axis := func(prev, next int, okPrev, okNext bool) float64 {
+		d := dc.DepthBuffer
+		okPrev = okPrev && d[prev] != math.MaxFloat64
+		okNext = okNext && d[next] != math.MaxFloat64
+		if dc.NormalBuffer != nil {
+			n := dc.NormalBuffer[i]
+			okPrev = okPrev && n.Dot(dc.NormalBuffer[prev]) > 0.9
+			okNext = okNext && n.Dot(dc.NormalBuffer[next]) > 0.9
+		}
+		switch {
+		case okPrev && okNext:
+			a, b := d[i]-d[prev], d[next]-d[i]
+			if math.Abs(a) < math.Abs(b) {
+				return a
+			}
+			return b
+		case okPrev:
+			return d[i] - d[prev]
+		case okNext:
+			return d[next] - d[i]
+		}
+		return 0
+	}
+	gx := axis(i-1, i+1, x > 0, x < w-1)
+	gy := axis(i-w, i+w, y > 0, y < h-1)
+	return gx, gy
+}
@@ -0,0 +1,146 @@
+package aeno
+
+// CompareFunc selects how the stencil test compares the reference value
+// with the stored one.
+type CompareFunc int
+
+const (
+	_ CompareFunc = iota
+	CompareNever
+	CompareLess
+	CompareLessEqual
+	CompareEqual
+	CompareGreater
+	CompareGreaterEqual
+	CompareNotEqual
+	CompareAlways
+)
+
+// Compare reports whether ref passes against value.
+func (f CompareFunc) Compare(ref, value uint8) bool {
+	switch f {
+	case CompareNever:
+		return false
+	case CompareLess:
+		return ref < value
+	case CompareLessEqual:
+		return ref <= value
+	case CompareEqual:
+		return ref == value
+	case CompareGreater:
+		return ref > value
+	case CompareGreaterEqual:
+		return ref >= value
+	case CompareNotEqual:
+		return ref != value
+	}
+	return true
+}
+
+// StencilOp selects how a stencil value is updated.
+type StencilOp int
+
+const (
+	_ StencilOp = iota
+	StencilKeep
+	StencilZero
+	StencilReplace
+	// StencilIncr and StencilDecr saturate at 255 and 0, the Wrap variants
+	// wrap around.
+	StencilIncr
+	StencilIncrWrap
+	StencilDecr
+	StencilDecrWrap
+	StencilInvert
+)
+
+// EnableStencil allocates StencilBuffer and turns on the stencil test.
+func (dc *Context) EnableStencil() {
+	dc.StencilBuffer = make([]uint8, dc.Width*dc.Height)
+	dc.StencilTest = true
+}
+
+// ClearStencilBuffer sets every stencil value to ClearStencil.
+func (dc *Context) ClearStencilBuffer() {
+	if dc.StencilBuffer == nil {
+		return
+	}
+	dc.clearSpans(func(i0, i1 int) {
+		for i := i0; i < i1; i++ {
+			dc.StencilBuffer[i] = dc.ClearStencil
+		}
+	})
+}
+
+func (dc *Context) stencilEnabled() bool {
+	return dc.StencilTest && dc.StencilBuffer != nil
+}
+
+// stencilTest compares StencilRef with the stored value through
+// StencilReadMask, as OpenGL does.
+func (dc *Context) stencilTest(i int) bool {
+	m := dc.StencilReadMask
+	return dc.StencilFunc.Compare(dc.StencilRef&m, dc.StencilBuffer[i]&m)
+}
+
+// stencilReject runs the stencil test for a fragment at pixel i before it
+// is shaded, applying StencilFail or StencilDepthFail when the fragment is
+// dropped.
+func (dc *Context) stencilReject(x, y, i int, depthPass bool) bool {
+	lock := &dc.locks[(x+y)&255]
+	lock.Lock()
+	defer lock.Unlock()
+	if !dc.stencilTest(i) {
+		dc.applyStencilOp(i, dc.StencilFail)
+		return true
+	}
+	if !depthPass {
+		dc.applyStencilOp(i, dc.StencilDepthFail)
+		return true
+	}
+	return false
+}
+
+// stencilPass re-tests the stencil of pixel i when a fragment is about to
+// be written and applies StencilPass. The caller holds the pixel lock.
+func (dc *Context) stencilPass(i int) bool {
+	if !dc.stencilEnabled() {
+		return true
+	}
+	if !dc.stencilTest(i) {
+		return false
+	}
+	dc.applyStencilOp(i, dc.StencilPass)
+	return true
+}
+
+func (dc *Context) applyStencilOp(i int, op StencilOp) {
+	s := dc.StencilBuffer[i]
+	var v uint8
+	switch op {
+	case StencilZero:
+		v = 0
+	case StencilReplace:
+		v = dc.StencilRef
+	case StencilIncr:
+		v = s
+		if s < 255 {
+			v++
+		}
+	case StencilIncrWrap:
+		v = s + 1
+	case StencilDecr:
+		v = s
+		if s > 0 {
+			v--
+		}
+	case StencilDecrWrap:
+		v = s - 1
+	case StencilInvert:
+		v = ^s
+	default:
+		return
+	}
+	m := dc.StencilWriteMask
+	dc.StencilBuffer[i] = s&^m | v&m
+}
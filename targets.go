@@ -0,0 +1,154 @@
+package aeno
+
+// Target selects optional per-pixel render targets.
+type Target int
+
+const (
+	TargetNormal Target = 1 << iota
+	TargetPosition
+	TargetTexture
+	TargetObject
+	TargetTriangle
+	TargetMaterial
+)
+
+// TargetPick selects the targets Pick reads.
+const TargetPick = TargetObject | TargetTriangle | TargetPosition
+
+// EnableTargets allocates the render targets selected by targets. They are
+// written wherever depth is written and cleared together with the depth
+// buffer.
+func (dc *Context) EnableTargets(targets Target) {
+	n := dc.Width * dc.Height
+	if targets&TargetNormal != 0 {
+		dc.NormalBuffer = make([]Vector, n)
+	}
+	if targets&TargetPosition != 0 {
+		dc.PositionBuffer = make([]Vector, n)
+	}
+	if targets&TargetTexture != 0 {
+		dc.TextureBuffer = make([]Vector, n)
+	}
+	if targets&TargetObject != 0 {
+		dc.ObjectBuffer = make([]int32, n)
+	}
+	if targets&TargetTriangle != 0 {
+		dc.TriangleBuffer = make([]int32, n)
+		for i := range dc.TriangleBuffer {
+			dc.TriangleBuffer[i] = -1
+		}
+	}
+	if targets&TargetMaterial != 0 {
+		dc.MaterialBuffer = make([]int32, n)
+	}
+}
+
+// EnableNormalBuffer allocates NormalBuffer.
+func (dc *Context) EnableNormalBuffer() {
+	dc.EnableTargets(TargetNormal)
+}
+
+// ObjectID returns the ID written to ObjectBuffer for o, assigning the next
+// free one if o has not been drawn yet. IDs start at 1; 0 means no object.
+// An ID stays valid until ResetObjectIDs, which a ClearDepthBuffer of the
+// whole buffer calls.
+func (dc *Context) ObjectID(o *Object) int32 {
+	if id, ok := dc.objectIDs.Load(o); ok {
+		return id.(int32)
+	}
+	dc.objectsLock.Lock()
+	defer dc.objectsLock.Unlock()
+	if id, ok := dc.objectIDs.Load(o); ok {
+		return id.(int32)
+	}
+	dc.objects = append(dc.objects, o)
+	id := int32(len(dc.objects))
+	dc.objectIDs.Store(o, id)
+	return id
+}
+
+// ObjectForID returns the object with the given ObjectBuffer ID, or nil.
+func (dc *Context) ObjectForID(id int32) *Object {
+	dc.objectsLock.Lock()
+	defer dc.objectsLock.Unlock()
+	if id < 1 || int(id) > len(dc.objects) {
+		return nil
+	}
+	return dc.objects[id-1]
+}
+
+// ResetObjectIDs forgets all objects and their IDs, so the next objects
+// drawn are numbered from 1 again. It must not be called while drawing.
+func (dc *Context) ResetObjectIDs() {
+	dc.objectsLock.Lock()
+	defer dc.objectsLock.Unlock()
+	dc.objectIDs.Range(func(o, _ interface{}) bool {
+		dc.objectIDs.Delete(o)
+		return true
+	})
+	dc.objects = nil
+}
+
+// registerObject assigns o an ID before drawing so the rasterizer only
+// reads the ID map.
+func (dc *Context) registerObject(o *Object) {
+	if o != nil && dc.ObjectBuffer != nil {
+		dc.ObjectID(o)
+	}
+}
+
+// clearTargets clears the pixels with indexes in [i0, i1).
+func (dc *Context) clearTargets(i0, i1 int) {
+	for i := i0; i < i1; i++ {
+		if dc.NormalBuffer != nil {
+			dc.NormalBuffer[i] = Vector{}
+		}
+		if dc.PositionBuffer != nil {
+			dc.PositionBuffer[i] = Vector{}
+		}
+		if dc.TextureBuffer != nil {
+			dc.TextureBuffer[i] = Vector{}
+		}
+		if dc.ObjectBuffer != nil {
+			dc.ObjectBuffer[i] = 0
+		}
+		if dc.TriangleBuffer != nil {
+			dc.TriangleBuffer[i] = -1
+		}
+		if dc.MaterialBuffer != nil {
+			dc.MaterialBuffer[i] = 0
+		}
+	}
+}
+
+// writeTargets stores the per-pixel surface attributes that accompany a
+// depth write at index i. tri is the index of the triangle in the drawn
+// mesh, or -1.
+func (dc *Context) writeTargets(i int, v Vertex, tri int, fromObject *Object) {
+	matrix := Identity()
+	if fromObject != nil {
+		matrix = fromObject.Matrix
+	}
+	if dc.NormalBuffer != nil && v.Normal != (Vector{}) {
+		dc.NormalBuffer[i] = matrix.MulDirection(v.Normal)
+	}
+	if dc.PositionBuffer != nil {
+		dc.PositionBuffer[i] = matrix.MulPosition(v.Position)
+	}
+	if dc.TextureBuffer != nil {
+		dc.TextureBuffer[i] = v.Texture
+	}
+	if dc.TriangleBuffer != nil {
+		dc.TriangleBuffer[i] = int32(tri)
+	}
+	if fromObject == nil {
+		return
+	}
+	if dc.ObjectBuffer != nil {
+		id, _ := dc.objectIDs.Load(fromObject)
+		dc.ObjectBuffer[i], _ = id.(int32)
+	}
+	if dc.MaterialBuffer != nil {
+		dc.MaterialBuffer[i] = fromObject.MaterialID
+	}
+}
@@ -0,0 +1,30 @@
+package aeno
+
+import "testing"
+
+func TestObjectIDsReset(t *testing.T) {
+	dc := NewContext(16, 16, NewSolidColorShader(Identity(), White, 0))
+	dc.EnableTargets(TargetObject)
+	mesh := NewPlane()
+	mesh.Transform(Scale(V(2, 2, 1)))
+	for frame := 0; frame < 3; frame++ {
+		dc.ClearDepthBuffer()
+		o := NewObject(mesh)
+		dc.DrawMesh(mesh, o)
+		if id := dc.ObjectBuffer[8*16+8]; id != 1 || dc.ObjectForID(id) != o {
+			t.Fatalf("frame %d: center ID %d maps to %p, want 1 and %p", frame, id, dc.ObjectForID(id), o)
+		}
+	}
+
+	// A scissored clear keeps the IDs the rest of the buffer refers to.
+	first := dc.ObjectForID(1)
+	dc.SetScissor(0, 0, 4, 4)
+	dc.ClearDepthBuffer()
+	if dc.ObjectForID(1) != first {
+		t.Errorf("scissored clear reset the object IDs")
+	}
+	dc.ResetObjectIDs()
+	if dc.ObjectForID(1) != nil {
+		t.Errorf("ResetObjectIDs kept object 1")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"image"
 	"net/http"
+	"sync"
 	"time"
 	_ "image/jpeg" // Ensure decoders are present
 	_ "image/png"
@@ -15,18 +16,184 @@ type Texture interface {
 	BilinearSample(u, v float64) Color
 }
 
+// gradientTexture is implemented by textures that can use the screen-space
+// derivatives of the texture coordinate to pick a mip level. Other
+// textures are sampled with BilinearSample.
+type gradientTexture interface {
+	SampleGrad(u, v float64, dx, dy Vector) Color
+}
+
+// WrapMode controls how texture coordinates outside [0, 1] are mapped.
+type WrapMode int
+
+const (
+	_ WrapMode = iota
+	WrapRepeat
+	WrapClampToEdge
+	WrapMirroredRepeat
+)
+
+// Filter selects how texels are combined when sampling. MagFilter only
+// uses FilterNearest and FilterLinear; the mipmap variants apply to
+// MinFilter and name the in-level filter first, the between-level second.
+type Filter int
+
+const (
+	_ Filter = iota
+	FilterNearest
+	FilterLinear
+	FilterNearestMipmapNearest
+	FilterLinearMipmapNearest
+	FilterNearestMipmapLinear
+	FilterLinearMipmapLinear
+)
+
 type ImageTexture struct {
 	Width  int
 	Height int
 	Image  image.Image
+	WrapS  WrapMode
+	WrapT  WrapMode
+	// MagFilter is used when a texel covers more than a pixel, MinFilter
+	// when a pixel covers more than a texel.
+	MagFilter Filter
+	MinFilter Filter
+	// Anisotropy is the maximum number of samples SampleGrad takes along
+	// the major axis of the pixel footprint. 0 or 1 means plain trilinear.
+	Anisotropy int
+	mips       []*texelLevel
+	once       sync.Once
+	opaque     bool
 }
 
 func NewImageTexture(im image.Image) Texture {
-	return &ImageTexture{
-		Width:  im.Bounds().Dx(),
-		Height: im.Bounds().Dy(),
-		Image:  im,
+	t := &ImageTexture{
+		Width:     im.Bounds().Dx(),
+		Height:    im.Bounds().Dy(),
+		Image:     im,
+		WrapS:     WrapRepeat,
+		WrapT:     WrapRepeat,
+		MagFilter: FilterLinear,
+		MinFilter: FilterLinearMipmapLinear,
 	}
+	t.GenerateMipmaps()
+	return t
+}
+
+// GenerateMipmaps converts Image into packed premultiplied float texels and
+// builds the mip chain by repeatedly halving it with a box filter. It must
+// be called again if Image is replaced.
+func (t *ImageTexture) GenerateMipmaps() {
+	level := packImage(t.Image)
+	t.opaque = level.opaque()
+	t.mips = []*texelLevel{level}
+	if level.Width == 0 || level.Height == 0 {
+		return
+	}
+	for level.Width > 1 || level.Height > 1 {
+		level = level.downsample()
+		t.mips = append(t.mips, level)
+	}
+}
+
+// texelLevel is one mip level stored as packed premultiplied RGBA values,
+// four float32 per texel in row-major order.
+type texelLevel struct {
+	Width  int
+	Height int
+	Pix    []float32
+}
+
+// Opaque reports whether every texel of the texture has full alpha.
+func (t *ImageTexture) Opaque() bool {
+	t.levels()
+	return t.opaque
+}
+
+func (l *texelLevel) opaque() bool {
+	for i := 3; i < len(l.Pix); i += 4 {
+		if l.Pix[i] < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// packImage converts an image into a texelLevel, reading the pixel slices
+// of common concrete image types directly instead of going through At.
+func packImage(im image.Image) *texelLevel {
+	b := im.Bounds()
+	w, h := b.Dx(), b.Dy()
+	pix := make([]float32, w*h*4)
+	const d = 1.0 / 255
+	switch src := im.(type) {
+	case *image.NRGBA:
+		for y := 0; y < h; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				i := (y*w + x) * 4
+				a := float32(row[x*4+3]) * d
+				pix[i+0] = float32(row[x*4+0]) * d * a
+				pix[i+1] = float32(row[x*4+1]) * d * a
+				pix[i+2] = float32(row[x*4+2]) * d * a
+				pix[i+3] = a
+			}
+		}
+	case *image.RGBA:
+		for y := 0; y < h; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w*4; x++ {
+				pix[y*w*4+x] = float32(row[x]) * d
+			}
+		}
+	case *image.Gray:
+		for y := 0; y < h; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				i := (y*w + x) * 4
+				g := float32(row[x]) * d
+				pix[i+0], pix[i+1], pix[i+2], pix[i+3] = g, g, g, 1
+			}
+		}
+	default:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				i := (y*w + x) * 4
+				c := MakeColor(im.At(b.Min.X+x, b.Min.Y+y))
+				pix[i+0] = float32(c.R)
+				pix[i+1] = float32(c.G)
+				pix[i+2] = float32(c.B)
+				pix[i+3] = float32(c.A)
+			}
+		}
+	}
+	return &texelLevel{w, h, pix}
+}
+
+// downsample returns the next mip level using a 2x2 box filter.
+func (l *texelLevel) downsample() *texelLevel {
+	w, h := maxInt(l.Width/2, 1), maxInt(l.Height/2, 1)
+	pix := make([]float32, w*h*4)
+	for y := 0; y < h; y++ {
+		y0 := minInt(y*2, l.Height-1) * l.Width
+		y1 := minInt(y*2+1, l.Height-1) * l.Width
+		for x := 0; x < w; x++ {
+			x0 := minInt(x*2, l.Width-1)
+			x1 := minInt(x*2+1, l.Width-1)
+			i := (y*w + x) * 4
+			for c := 0; c < 4; c++ {
+				sum := l.Pix[(y0+x0)*4+c] + l.Pix[(y0+x1)*4+c] + l.Pix[(y1+x0)*4+c] + l.Pix[(y1+x1)*4+c]
+				pix[i+c] = sum * 0.25
+			}
+		}
+	}
+	return &texelLevel{w, h, pix}
+}
+
+// at returns the texel at x, y, which must be in range.
+func (l *texelLevel) at(x, y int) Color {
+	p := l.Pix[(y*l.Width+x)*4:]
+	return Color{float64(p[0]), float64(p[1]), float64(p[2]), float64(p[3])}
 }
 
 func LoadTexture(path string) (Texture, error) {
@@ -62,47 +229,152 @@ func TexFromBytes(data []byte) Texture {
 	return NewImageTexture(im)
 }
 
+// Sample samples the base level with nearest filtering.
 func (t *ImageTexture) Sample(u, v float64) Color {
-	// Wrap coords
-	u = u - math.Floor(u)
-	v = v - math.Floor(v)
-	
-	x := int(u * float64(t.Width))
-	y := int(v * float64(t.Height))
-	
-	// Bounds check
-	if x >= t.Width { x = t.Width - 1 }
-	if y >= t.Height { y = t.Height - 1 }
-	
-	return MakeColor(t.Image.At(x, y))
+	return t.sampleLevel(0, u, v, false)
 }
 
+// BilinearSample samples the base level with bilinear filtering.
 func (t *ImageTexture) BilinearSample(u, v float64) Color {
-	u = math.Max(0, math.Min(1.0-1e-9, u))
-    v = math.Max(0, math.Min(1.0-1e-9, v))
+	return t.sampleLevel(0, u, v, true)
+}
 
-   	uScaled := u * float64(t.Width-1)
-    vScaled := v * float64(t.Height-1)
+// levels returns the mip chain, generating it on first use when the
+// texture was not built with NewImageTexture.
+func (t *ImageTexture) levels() []*texelLevel {
+	t.once.Do(func() {
+		if len(t.mips) == 0 {
+			t.GenerateMipmaps()
+		}
+	})
+	return t.mips
+}
 
-    x0, y0 := int(uScaled), int(vScaled)
-	
-    x1 := x0 + 1
-    y1 := y0 + 1
-    if x1 >= t.Width { x1 = t.Width - 1 }
-    if y1 >= t.Height { y1 = t.Height - 1 }
-    if x0 >= t.Width { x0 = t.Width - 1 } // Safety clamp
-    if y0 >= t.Height { y0 = t.Height - 1 }
-	
-	uFrac := uScaled - math.Floor(uScaled)
-    vFrac := vScaled - math.Floor(vScaled)
+// wrapIndex maps texel index i into [0, n) according to mode.
+func wrapIndex(i, n int, mode WrapMode) int {
+	switch mode {
+	case WrapClampToEdge:
+		return ClampInt(i, 0, n-1)
+	case WrapMirroredRepeat:
+		period := 2 * n
+		i %= period
+		if i < 0 {
+			i += period
+		}
+		if i >= n {
+			i = period - 1 - i
+		}
+		return i
+	default:
+		i %= n
+		if i < 0 {
+			i += n
+		}
+		return i
+	}
+}
+
+// sampleLevel samples mip level l with nearest or bilinear filtering,
+// treating texel centers as lying at half-integer coordinates.
+func (t *ImageTexture) sampleLevel(l int, u, v float64, linear bool) Color {
+	im := t.levels()[l]
+	w, h := im.Width, im.Height
+	if w == 0 || h == 0 {
+		return Transparent
+	}
 
-    c00 := MakeColor(t.Image.At(x0, y0))
-    c10 := MakeColor(t.Image.At(x1, y0))
-    c01 := MakeColor(t.Image.At(x0, y1))
-    c11 := MakeColor(t.Image.At(x1, y1))
+	if !linear {
+		x := wrapIndex(int(math.Floor(u*float64(w))), w, t.WrapS)
+		y := wrapIndex(int(math.Floor(v*float64(h))), h, t.WrapT)
+		return im.at(x, y)
+	}
 
-    top := c00.Lerp(c10, uFrac)
-    bottom := c01.Lerp(c11, uFrac)
+	fx := u*float64(w) - 0.5
+	fy := v*float64(h) - 0.5
+	x0 := int(math.Floor(fx))
+	y0 := int(math.Floor(fy))
+	uFrac := fx - float64(x0)
+	vFrac := fy - float64(y0)
 
-    return top.Lerp(bottom, vFrac)
+	x1 := wrapIndex(x0+1, w, t.WrapS)
+	y1 := wrapIndex(y0+1, h, t.WrapT)
+	x0 = wrapIndex(x0, w, t.WrapS)
+	y0 = wrapIndex(y0, h, t.WrapT)
+
+	c00 := im.at(x0, y0)
+	c10 := im.at(x1, y0)
+	c01 := im.at(x0, y1)
+	c11 := im.at(x1, y1)
+
+	top := c00.Lerp(c10, uFrac)
+	bottom := c01.Lerp(c11, uFrac)
+	return top.Lerp(bottom, vFrac)
+}
+
+// SampleLevel samples the texture at the given level of detail using
+// MagFilter when lod <= 0 and MinFilter otherwise. With the default
+// FilterLinearMipmapLinear this blends bilinear samples from the two
+// nearest mip levels (trilinear filtering). A NaN lod samples the base
+// level.
+func (t *ImageTexture) SampleLevel(u, v, lod float64) Color {
+	if lod <= 0 || math.IsNaN(lod) {
+		return t.sampleLevel(0, u, v, t.MagFilter != FilterNearest)
+	}
+	last := len(t.levels()) - 1
+	switch t.MinFilter {
+	case FilterNearest:
+		return t.sampleLevel(0, u, v, false)
+	case FilterLinear:
+		return t.sampleLevel(0, u, v, true)
+	case FilterNearestMipmapNearest, FilterLinearMipmapNearest:
+		l := ClampInt(int(math.Floor(lod+0.5)), 0, last)
+		return t.sampleLevel(l, u, v, t.MinFilter == FilterLinearMipmapNearest)
+	}
+	linear := t.MinFilter != FilterNearestMipmapLinear
+	if lod >= float64(last) {
+		return t.sampleLevel(last, u, v, linear)
+	}
+	l := int(lod)
+	c0 := t.sampleLevel(l, u, v, linear)
+	c1 := t.sampleLevel(l+1, u, v, linear)
+	return c0.Lerp(c1, lod-float64(l))
+}
+
+// SampleGrad samples the texture, choosing the level of detail from dx
+// and dy, the change in texture coordinate across one pixel horizontally
+// and vertically. When Anisotropy is above 1 and MinFilter uses mipmaps,
+// several samples are averaged along the longer axis of the footprint.
+func (t *ImageTexture) SampleGrad(u, v float64, dx, dy Vector) Color {
+	base := t.levels()[0]
+	size := Vector{float64(base.Width), float64(base.Height), 0}
+	lx := Vector{dx.X, dx.Y, 0}.Mul(size).Length()
+	ly := Vector{dy.X, dy.Y, 0}.Mul(size).Length()
+	major, pmax, pmin := dx, lx, ly
+	if ly > lx {
+		major, pmax, pmin = dy, ly, lx
+	}
+	if pmax <= 1 {
+		return t.SampleLevel(u, v, 0)
+	}
+	if math.IsNaN(pmax) || math.IsInf(pmax, 1) {
+		// Degenerate derivatives, e.g. next to an edge-on triangle.
+		return t.SampleLevel(u, v, pmax)
+	}
+
+	n := 1
+	mipmapped := t.MinFilter != FilterNearest && t.MinFilter != FilterLinear
+	if mipmapped && t.Anisotropy > 1 && pmin > 0 {
+		n = minInt(int(math.Ceil(pmax/pmin)), t.Anisotropy)
+	}
+	if n <= 1 {
+		return t.SampleLevel(u, v, math.Log2(pmax))
+	}
+
+	lod := math.Max(math.Log2(pmax/float64(n)), 1e-9)
+	var c Color
+	for i := 0; i < n; i++ {
+		o := (float64(i)+0.5)/float64(n) - 0.5
+		c = c.Add(t.SampleLevel(u+major.X*o, v+major.Y*o, lod))
+	}
+	return c.DivScalar(float64(n))
 }
@@ -0,0 +1,168 @@
+package aeno
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// testImages returns the same checker pattern as an NRGBA image, which
+// packImage reads directly, and as a YCbCr image, which goes through At.
+func testImages(size int) map[string]image.Image {
+	r := image.Rect(0, 0, size, size)
+	nrgba := image.NewNRGBA(r)
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio444)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := color.NRGBA{uint8(x * 255 / size), uint8(y * 255 / size), 64, 255}
+			if (x/8+y/8)%2 == 0 {
+				c.B = 192
+			}
+			nrgba.SetNRGBA(x, y, c)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = yy
+			ycbcr.Cb[ycbcr.COffset(x, y)] = cb
+			ycbcr.Cr[ycbcr.COffset(x, y)] = cr
+		}
+	}
+	return map[string]image.Image{"NRGBA": nrgba, "YCbCr": ycbcr}
+}
+
+func TestPackImage(t *testing.T) {
+	r := image.Rect(2, 3, 7, 9)
+	nrgba := image.NewNRGBA(r)
+	rgba := image.NewRGBA(r)
+	gray := image.NewGray(r)
+	paletted := image.NewPaletted(r, color.Palette{color.Black, color.NRGBA{200, 100, 50, 128}})
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.NRGBA{uint8(x * 30), uint8(y * 20), uint8(x * y), uint8(x*40 + y)}
+			nrgba.SetNRGBA(x, y, c)
+			rgba.Set(x, y, c)
+			gray.Set(x, y, c)
+			paletted.SetColorIndex(x, y, uint8((x+y)%2))
+		}
+	}
+	for _, im := range []image.Image{nrgba, rgba, gray, paletted} {
+		level := packImage(im)
+		if level.Width != r.Dx() || level.Height != r.Dy() {
+			t.Fatalf("%T: size %dx%d, want %dx%d", im, level.Width, level.Height, r.Dx(), r.Dy())
+		}
+		for y := 0; y < level.Height; y++ {
+			for x := 0; x < level.Width; x++ {
+				got := level.at(x, y)
+				want := MakeColor(im.At(r.Min.X+x, r.Min.Y+y))
+				d := got.Sub(want)
+				if math.Abs(d.R) > 1e-3 || math.Abs(d.G) > 1e-3 || math.Abs(d.B) > 1e-3 || math.Abs(d.A) > 1e-3 {
+					t.Fatalf("%T: texel %d,%d = %v, want %v", im, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	// Images with no pixels build without mips and sample as transparent.
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 5), image.Rect(0, 0, 5, 0), image.Rect(0, 0, 0, 0)} {
+		tx := NewImageTexture(image.NewNRGBA(r)).(*ImageTexture)
+		if c := tx.SampleGrad(0.5, 0.5, Vector{0.1, 0, 0}, Vector{0, 0.1, 0}); c != Transparent {
+			t.Errorf("%v: sampled %v, want transparent", r, c)
+		}
+	}
+}
+
+func BenchmarkTexturedRender(b *testing.B) {
+	mesh := NewPlane()
+	for _, tri := range mesh.Triangles {
+		for _, v := range []*Vertex{&tri.V1, &tri.V2, &tri.V3} {
+			v.Texture = Vector{(v.Position.X + 0.5) * 4, (v.Position.Y + 0.5) * 4, 0}
+		}
+	}
+	eye, center, up := V(0, -1.2, 0.6), V(0, 0, 0), V(0, 0, 1)
+	matrix := LookAt(eye, center, up).Perspective(50, 1, 0.1, 10)
+	light := V(0.5, -1, 1).Normalize()
+	images := testImages(256)
+	for _, name := range []string{"NRGBA", "YCbCr"} {
+		im := images[name]
+		// Both textures filter bilinearly from the full image, so the
+		// difference is the cost of reading packed texels against At.
+		packed := NewImageTexture(im).(*ImageTexture)
+		packed.MinFilter = FilterLinear
+		textures := []struct {
+			name    string
+			texture Texture
+		}{
+			{"Packed", packed},
+			{"At", atTexture{im}},
+		}
+		for _, tc := range textures {
+			b.Run(name+"/"+tc.name, func(b *testing.B) {
+				shader := NewPhongShader(matrix, light, eye, Gray(0.3), Gray(0.7))
+				dc := NewContext(256, 256, shader)
+				dc.Cull = CullNone
+				object := NewObject(mesh)
+				object.Texture = tc.texture
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					dc.ClearColorBufferWith(Black)
+					dc.ClearDepthBuffer()
+					dc.DrawMesh(mesh, object)
+				}
+			})
+		}
+	}
+}
+
+// atTexture samples an image through At and MakeColor for every texel, as
+// ImageTexture did before it packed its texels. It is the baseline for
+// BenchmarkTexturedRender.
+type atTexture struct {
+	im image.Image
+}
+
+func (t atTexture) texel(x, y int) Color {
+	b := t.im.Bounds()
+	x = wrapIndex(x, b.Dx(), WrapRepeat)
+	y = wrapIndex(y, b.Dy(), WrapRepeat)
+	return MakeColor(t.im.At(b.Min.X+x, b.Min.Y+y))
+}
+
+func (t atTexture) Sample(u, v float64) Color {
+	b := t.im.Bounds()
+	return t.texel(int(math.Floor(u*float64(b.Dx()))), int(math.Floor(v*float64(b.Dy()))))
+}
+
+func (t atTexture) BilinearSample(u, v float64) Color {
+	b := t.im.Bounds()
+	fx := u*float64(b.Dx()) - 0.5
+	fy := v*float64(b.Dy()) - 0.5
+	x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+	uFrac, vFrac := fx-float64(x0), fy-float64(y0)
+	top := t.texel(x0, y0).Lerp(t.texel(x0+1, y0), uFrac)
+	bottom := t.texel(x0, y0+1).Lerp(t.texel(x0+1, y0+1), uFrac)
+	return top.Lerp(bottom, vFrac)
+}
+
+func TestSampleGrad(t *testing.T) {
+	im := image.NewGray(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if (x+y)%2 == 0 {
+				im.Pix[y*im.Stride+x] = 255
+			}
+		}
+	}
+	built := NewImageTexture(im).(*ImageTexture)
+	literal := &ImageTexture{Image: im, MagFilter: FilterLinear, MinFilter: FilterLinearMipmapLinear}
+	dx, dy := Vector{0.5, 0, 0}, Vector{0, 0.5, 0}
+	for _, tx := range []*ImageTexture{built, literal} {
+		// A footprint of 8 texels averages the checker to mid gray.
+		if c := tx.SampleGrad(0.3, 0.3, dx, dy); math.Abs(c.R-0.5) > 1e-3 {
+			t.Errorf("minified sample = %v, want mid gray", c)
+		}
+		nan := Vector{math.NaN(), 0, 0}
+		inf := Vector{math.Inf(1), 0, 0}
+		tx.SampleGrad(0.5, 0.5, nan, Vector{})
+		tx.SampleGrad(0.5, 0.5, Vector{}, nan)
+		tx.SampleGrad(0.5, 0.5, inf, Vector{0, 0.1, 0})
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Radians f
@@ -71,6 +73,22 @@ func ParseFloats(items []string) []float64 {
 	return result
 }
 
+// parallel calls fn(i) for i in [0, n) spread over all logical CPUs.
+func parallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	wn := runtime.NumCPU()
+	wg.Add(wn)
+	for wi := 0; wi < wn; wi++ {
+		go func(wi int) {
+			for i := wi; i < n; i += wn {
+				fn(i)
+			}
+			wg.Done()
+		}(wi)
+	}
+	wg.Wait()
+}
+
 // Clamp f
 func Clamp(x, lo, hi float64) float64 {
 	if x < lo {
@@ -93,6 +111,22 @@ func ClampInt(x, lo, hi int) int {
 	return x
 }
 
+// minInt f
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxInt f
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 // AbsInt f
 func AbsInt(x int) int {
 	if x < 0 {
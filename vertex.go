@@ -5,8 +5,10 @@ type Vertex struct {
 	Position Vector
 	Normal   Vector
 	Texture  Vector
-	Color    Color
-	Output   VectorW
+	// Color is sRGB encoded, like Object.Color, and is decoded to linear
+	// light when the Context uses ColorSpaceSRGB.
+	Color  Color
+	Output VectorW
 }
 
 // Outside f
@@ -0,0 +1,60 @@
+package aeno
+
+import "image"
+
+// bounds returns the whole buffer rectangle.
+func (dc *Context) bounds() image.Rectangle {
+	return image.Rect(0, 0, dc.Width, dc.Height)
+}
+
+// SetViewport maps normalized device coordinates to the given rectangle of
+// the buffers, with x and y measured from the top left corner.
+func (dc *Context) SetViewport(x, y, width, height int) {
+	dc.Viewport = image.Rect(x, y, x+width, y+height)
+}
+
+// SetScissor enables the scissor test with the given rectangle.
+func (dc *Context) SetScissor(x, y, width, height int) {
+	dc.Scissor = image.Rect(x, y, x+width, y+height)
+	dc.ScissorTest = true
+}
+
+// viewportMatrix maps normalized device coordinates to Viewport.
+func (dc *Context) viewportMatrix() Matrix {
+	r := dc.Viewport
+	if r.Empty() {
+		return Screen(dc.Width, dc.Height)
+	}
+	w2 := float64(r.Dx()) / 2
+	h2 := float64(r.Dy()) / 2
+	return Matrix{
+		w2, 0, 0, float64(r.Min.X) + w2,
+		0, -h2, 0, float64(r.Min.Y) + h2,
+		0, 0, 0.5, 0.5,
+		0, 0, 0, 1,
+	}
+}
+
+// clipRect returns the rectangle rasterization is limited to.
+func (dc *Context) clipRect() image.Rectangle {
+	if dc.ScissorTest {
+		return dc.Scissor.Intersect(dc.bounds())
+	}
+	return dc.bounds()
+}
+
+// clearSpans calls fn with the [i0, i1) pixel index ranges a clear should
+// touch: the whole buffer, or one span per row of the scissor rectangle.
+func (dc *Context) clearSpans(fn func(i0, i1 int)) {
+	if !dc.ScissorTest {
+		fn(0, dc.Width*dc.Height)
+		return
+	}
+	r := dc.clipRect()
+	if r.Empty() {
+		return
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		fn(y*dc.Width+r.Min.X, y*dc.Width+r.Max.X)
+	}
+}